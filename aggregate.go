@@ -0,0 +1,251 @@
+package machinestats
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+var defaultAggregationPercentiles = []float64{50, 95, 99}
+
+// AggregationConfig configures an AggregatingSink
+type AggregationConfig struct {
+	// Window is how often aggregates are passed on to the inner sink
+	Window time.Duration
+	// Percentiles that are reported for every metric, between 0 and 100.
+	// Defaults to 50, 95 and 99.
+	Percentiles []float64
+}
+
+// AggregatingSink lets stats be collected at a fast rate while only passing a
+// summary of every window on to the inner sink. Each window produces, per
+// metric:
+//
+//   - gauges, timings, histograms and distributions: <name>.min, .max, .mean
+//     and .p<N> for every percentile, all as gauges
+//   - counters: the sum of all deltas as a single counter
+//   - sets: every unique member once
+//
+// Non-numeric gauges are passed on with their latest value.
+type AggregatingSink struct {
+	config  AggregationConfig
+	inner   Sink
+	started int64
+	order   []string
+	windows map[string]*aggregationWindow
+}
+
+// aggregationWindow holds everything written for one metric during a window
+type aggregationWindow struct {
+	latest  Measurement
+	samples []float64
+	sum     float64
+	members map[string]Measurement
+}
+
+// NewAggregatingSink creates an AggregatingSink that writes to inner
+func NewAggregatingSink(inner Sink, config AggregationConfig) (*AggregatingSink, error) {
+	if config.Window <= 0 {
+		return nil, fmt.Errorf("aggregation window must be positive")
+	}
+	if len(config.Percentiles) == 0 {
+		config.Percentiles = defaultAggregationPercentiles
+	}
+	for _, p := range config.Percentiles {
+		if p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile %v", p)
+		}
+	}
+	return &AggregatingSink{
+		config:  config,
+		inner:   inner,
+		started: nowFn(),
+		windows: make(map[string]*aggregationWindow),
+	}, nil
+}
+
+// Write adds the measurements to the current window
+func (a *AggregatingSink) Write(measurements []Measurement) error {
+	for _, m := range measurements {
+		name := m.Name()
+		w, ok := a.windows[name]
+		if !ok {
+			w = &aggregationWindow{}
+			a.windows[name] = w
+			a.order = append(a.order, name)
+		}
+		w.latest = m
+		switch m.Type() {
+		case Set:
+			if w.members == nil {
+				w.members = make(map[string]Measurement)
+			}
+			w.members[fmt.Sprintf("%v", m.Value())] = m
+		case Counter:
+			if value, ok := toFloat64(m.Value()); ok {
+				w.sum += value
+			}
+		default:
+			if value, ok := toFloat64(m.Value()); ok && !math.IsNaN(value) && !math.IsInf(value, 0) {
+				w.samples = append(w.samples, value)
+			}
+		}
+	}
+	return nil
+}
+
+// Flush passes the aggregates on to the inner sink once the window has
+// elapsed, and does nothing otherwise
+func (a *AggregatingSink) Flush() error {
+	if time.Duration(nowFn()-a.started) < a.config.Window {
+		return nil
+	}
+	return a.flushWindow()
+}
+
+// Close passes on the aggregates of the current, partial window and closes
+// the inner sink
+func (a *AggregatingSink) Close() error {
+	err := a.flushWindow()
+	if closeErr := a.inner.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (a *AggregatingSink) flushWindow() error {
+	now := nowFn()
+	a.started = now
+	if len(a.order) == 0 {
+		return nil
+	}
+	batch := make([]Measurement, 0)
+	for _, name := range a.order {
+		batch = append(batch, a.windows[name].aggregate(a.config.Percentiles, now)...)
+	}
+	a.order = nil
+	a.windows = make(map[string]*aggregationWindow)
+	if err := a.inner.Write(batch); err != nil {
+		return err
+	}
+	return a.inner.Flush()
+}
+
+// aggregate returns the measurements that summarize the window
+func (w *aggregationWindow) aggregate(percentiles []float64, timestamp int64) []Measurement {
+	switch w.latest.Type() {
+	case Set:
+		keys := make([]string, 0, len(w.members))
+		for key := range w.members {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		members := make([]Measurement, len(keys))
+		for idx, key := range keys {
+			members[idx] = w.members[key]
+		}
+		return members
+	case Counter:
+		return []Measurement{&aggregateMeasurement{w.latest, "", Counter, w.sum, timestamp}}
+	}
+	if len(w.samples) == 0 {
+		// Nothing numeric to aggregate
+		return []Measurement{w.latest}
+	}
+	sort.Float64s(w.samples)
+	sum := 0.0
+	for _, value := range w.samples {
+		sum += value
+	}
+	result := []Measurement{
+		&aggregateMeasurement{w.latest, "min", Gauge, w.samples[0], timestamp},
+		&aggregateMeasurement{w.latest, "max", Gauge, w.samples[len(w.samples)-1], timestamp},
+		&aggregateMeasurement{w.latest, "mean", Gauge, sum / float64(len(w.samples)), timestamp},
+	}
+	for _, p := range percentiles {
+		// p99.9 becomes p99_9 so that it stays a single path component
+		stat := strings.Replace(fmt.Sprintf("p%v", p), ".", "_", 1)
+		result = append(result, &aggregateMeasurement{w.latest, stat, Gauge, percentile(w.samples, p), timestamp})
+	}
+	return result
+}
+
+// percentile returns the p-th percentile of sorted using the nearest-rank
+// method
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// aggregateMeasurement summarizes the measurements of a metric over a window.
+// It keeps the labels, unit and description of the measurements it summarizes.
+type aggregateMeasurement struct {
+	base      Measurement
+	stat      string
+	statType  StatType
+	value     float64
+	timestamp int64
+}
+
+func (a *aggregateMeasurement) suffix(name string) string {
+	if a.stat == "" {
+		return name
+	}
+	return fmt.Sprintf("%v.%v", name, a.stat)
+}
+
+// Name of the measurement
+func (a *aggregateMeasurement) Name() string {
+	return a.suffix(a.base.Name())
+}
+
+// Type of the measurement
+func (a *aggregateMeasurement) Type() StatType {
+	return a.statType
+}
+
+// Value of the measurement
+func (a *aggregateMeasurement) Value() interface{} {
+	return a.value
+}
+
+// Timestamp at which the window ended
+func (a *aggregateMeasurement) Timestamp() int64 {
+	return a.timestamp
+}
+
+// Family of the measurement
+func (a *aggregateMeasurement) Family() string {
+	if lm, ok := a.base.(LabeledMeasurement); ok {
+		return a.suffix(lm.Family())
+	}
+	return a.Name()
+}
+
+// Labels of the measurement
+func (a *aggregateMeasurement) Labels() map[string]string {
+	if lm, ok := a.base.(LabeledMeasurement); ok {
+		return lm.Labels()
+	}
+	return nil
+}
+
+// Unit of the measurement
+func (a *aggregateMeasurement) Unit() Unit {
+	unit, _ := measurementMetadata(a.base)
+	return unit
+}
+
+// Description of the measurement
+func (a *aggregateMeasurement) Description() string {
+	_, description := measurementMetadata(a.base)
+	if description == "" || a.stat == "" {
+		return description
+	}
+	return fmt.Sprintf("%v (%v)", description, a.stat)
+}
@@ -0,0 +1,98 @@
+package machinestats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregatingSink(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	now := int64(0)
+	nowFn = func() int64 { return now }
+
+	inner := &mockSink{}
+	sink, err := NewAggregatingSink(inner, AggregationConfig{Window: 10 * time.Second})
+	require.Nil(err)
+
+	for idx := 1; idx <= 10; idx++ {
+		now = int64(time.Duration(idx) * time.Second)
+		require.Nil(sink.Write([]Measurement{
+			&cpuBusyMeasurement{-1, float64(idx) / 10, now},
+			&BasicMeasurement{name: "requests", measurementType: Counter, value: 2},
+			&BasicMeasurement{name: "users", measurementType: Set, value: idx % 2},
+			&BasicMeasurement{name: "version", measurementType: Gauge, value: "v1"},
+		}))
+		require.Nil(sink.Flush())
+		if idx < 10 {
+			// Nothing is passed on before the window has elapsed
+			require.Empty(inner.written)
+		}
+	}
+	require.Equal(1, inner.flushes)
+
+	values := make(map[string]interface{})
+	for _, m := range inner.written {
+		values[m.Name()] = m.Value()
+		if _, ok := m.(*aggregateMeasurement); ok {
+			require.Equal(int64(10*time.Second), measurementTime(m, 0), m.Name())
+		}
+	}
+	require.Equal(map[string]interface{}{
+		"cpu-load.-1.min":  0.1,
+		"cpu-load.-1.max":  1.0,
+		"cpu-load.-1.mean": 0.55,
+		"cpu-load.-1.p50":  0.5,
+		"cpu-load.-1.p95":  1.0,
+		"cpu-load.-1.p99":  1.0,
+		"requests":         20.0,
+		"users":            1,
+		"version":          "v1",
+	}, values)
+	require.Equal(10, len(inner.written))
+
+	// Aggregates keep the labels and metadata of the metric
+	p95 := inner.written[4].(*aggregateMeasurement)
+	require.Equal("cpu-load.p95", p95.Family())
+	require.Equal(map[string]string{"cpu": "total"}, p95.Labels())
+	require.Equal(UnitRatio, p95.Unit())
+	require.Equal(Gauge, p95.Type())
+
+	// Close passes on the partial window
+	inner.written = nil
+	require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "a", measurementType: Timing, value: 3}}))
+	require.Nil(sink.Close())
+	require.Equal(6, len(inner.written))
+	require.True(inner.closed)
+}
+
+func TestAggregatingSinkConfig(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewAggregatingSink(&mockSink{}, AggregationConfig{})
+	require.NotNil(err)
+	_, err = NewAggregatingSink(&mockSink{}, AggregationConfig{Window: time.Second, Percentiles: []float64{101}})
+	require.NotNil(err)
+
+	sink, err := NewAggregatingSink(&mockSink{}, AggregationConfig{Window: time.Second, Percentiles: []float64{99.9}})
+	require.Nil(err)
+	batch := (&aggregationWindow{
+		latest:  &BasicMeasurement{name: "a", measurementType: Gauge, value: 1},
+		samples: []float64{1},
+	}).aggregate(sink.config.Percentiles, 0)
+	require.Equal("a.p99_9", batch[3].Name())
+}
+
+func TestPercentile(t *testing.T) {
+	require := require.New(t)
+
+	sorted := []float64{1, 2, 3, 4}
+	require.Equal(1.0, percentile(sorted, 1))
+	require.Equal(2.0, percentile(sorted, 50))
+	require.Equal(4.0, percentile(sorted, 99))
+	require.Equal(4.0, percentile(sorted, 100))
+}
@@ -38,8 +38,10 @@ func NewBandwidthStat(fs *procfs.FS) (*BandwidthStat, error) {
 }
 
 type bandwidthMeasurement struct {
-	value float64
-	name  string
+	value     float64
+	iface     string
+	direction string
+	timestamp int64
 }
 
 func (b *bandwidthMeasurement) Type() StatType {
@@ -50,28 +52,52 @@ func (b *bandwidthMeasurement) Value() interface{} {
 	return b.value
 }
 
+func (b *bandwidthMeasurement) Timestamp() int64 {
+	return b.timestamp
+}
+
+func (b *bandwidthMeasurement) Unit() Unit {
+	return UnitMebibitsPerSecond
+}
+
+func (b *bandwidthMeasurement) Description() string {
+	return fmt.Sprintf("Network %v rate", b.direction)
+}
+
 func (b *bandwidthMeasurement) Name() string {
-	return b.name
+	return fmt.Sprintf("network.interfaces.%v.%v.mbps", b.iface, b.direction)
+}
+
+func (b *bandwidthMeasurement) Family() string {
+	return fmt.Sprintf("network.interfaces.%v.mbps", b.direction)
+}
+
+func (b *bandwidthMeasurement) Labels() map[string]string {
+	return map[string]string{"interface": b.iface}
 }
 
-func sendBandwidthDiffs(channel chan<- Measurement, iface string, timeDelta time.Duration, newData, oldData procfs.NetDevLine) {
+func sendBandwidthDiffs(channel chan<- Measurement, iface string, timestamp int64, timeDelta time.Duration, newData, oldData procfs.NetDevLine) {
 	downloaded := newData.RxBytes - oldData.RxBytes
 	uploaded := newData.TxBytes - oldData.TxBytes
 
 	log.Debugf("%v - downloaded (%v)", iface, downloaded)
 	log.Debugf("%v - uploaded   (%v)", iface, uploaded)
 
-	elapsedTimeInSeconds := float64(timeDelta / (time.Second))
+	elapsedTimeInSeconds := timeDelta.Seconds()
 	downloadSpeed := ((float64(downloaded) / elapsedTimeInSeconds) / megaByte) * 8
 	uploadSpeed := ((float64(uploaded) / elapsedTimeInSeconds) / megaByte) * 8
 
 	bm := &bandwidthMeasurement{
 		downloadSpeed,
-		fmt.Sprintf("network.interfaces.%v.download.mbps", iface),
+		iface,
+		"download",
+		timestamp,
 	}
 	um := &bandwidthMeasurement{
 		uploadSpeed,
-		fmt.Sprintf("network.interfaces.%v.upload.mbps", iface),
+		iface,
+		"upload",
+		timestamp,
 	}
 	channel <- bm
 	channel <- um
@@ -103,8 +129,8 @@ func (b *BandwidthStat) Measure(channel chan<- Measurement) error {
 		oldIfaceData := oldData[iface]
 		newIfaceData := newData[iface]
 
-		sendBandwidthDiffs(channel, iface, timeDelta, newIfaceData, oldIfaceData)
+		sendBandwidthDiffs(channel, iface, now, timeDelta, newIfaceData, oldIfaceData)
 	}
-	sendBandwidthDiffs(channel, "total", timeDelta, newTotal, oldTotal)
+	sendBandwidthDiffs(channel, "total", now, timeDelta, newTotal, oldTotal)
 	return nil
 }
@@ -98,3 +98,18 @@ func TestBandwidthStat(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestBandwidthRateOverFractionalSeconds(t *testing.T) {
+	require := require.New(t)
+
+	// Intervals that are not whole seconds, like the collector's sub-second or
+	// late cycles, are not rounded down
+	channel := make(chan Measurement, 2)
+	sendBandwidthDiffs(channel, "eth0", 0, 1500*time.Millisecond, procfs.NetDevLine{RxBytes: 3 * 1024 * 1024, TxBytes: 1024 * 1024}, procfs.NetDevLine{})
+	require.InDelta(16.0, (<-channel).Value(), 1e-9)
+	require.InDelta(16.0/3, (<-channel).Value(), 1e-9)
+
+	sendBandwidthDiffs(channel, "eth0", 0, 500*time.Millisecond, procfs.NetDevLine{RxBytes: 1024 * 1024}, procfs.NetDevLine{})
+	require.InDelta(16.0, (<-channel).Value(), 1e-9)
+	require.InDelta(0.0, (<-channel).Value(), 1e-9)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// notInConfig are the flags that the config file cannot set
+var notInConfig = map[string]bool{"help": true, "config": true}
+
+// cumulativeFlags maps each flag that can be repeated to a function that
+// clears it, since setting such a flag adds to its value
+var cumulativeFlags = map[string]func(){
+	"sink":                func() { *sinkNames = nil },
+	"auth-token":          func() { *authTokens = nil },
+	"auth-basic":          func() { *authBasic = nil },
+	"public-path":         func() { *publicPath = nil },
+	"ready-required-stat": func() { *readyRequiredStats = nil },
+	"otlp-header":         func() { *otlpHeaders = map[string]string{} },
+}
+
+// restartFlags are the flags whose changes only take effect after a restart
+var restartFlags = []string{
+	"procfs", "server-port", "bind-address", "tls-cert", "tls-key", "tls-client-ca",
+	"auth-token", "auth-basic", "public-path", "history-duration", "history-points",
+	"reload-endpoint",
+}
+
+// instanceName is what the names of coturn and HTTP instances may consist of,
+// since they become part of metric names
+var instanceName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// configError points at the key of the config file that is invalid
+type configError struct {
+	line    int
+	key     string
+	message string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("line %d: %v: %v", e.line, e.key, e.message)
+}
+
+func newConfigError(node *yaml.Node, key string, format string, args ...interface{}) error {
+	return &configError{node.Line, key, fmt.Sprintf(format, args...)}
+}
+
+// fileConfig is the content of the config file. Flags are set with their
+// names as top level keys, while the settings that flags cannot express have
+// sections of their own:
+//
+//	statsd-interval: 1000
+//	sink: [statsd, prometheus]
+//	coturn:
+//	  - name: edge
+//	    host: 10.0.0.2
+//	    port: 5558
+//	    password: secret
+//	    interval: 10s
+//	http-metrics:
+//	  - name: app
+//	    url: http://localhost:8080/metrics
+//	    prefix: app
+//	    metric: [app.requests.*]
+//	filters:
+//	  cpu-load-stat:
+//	    metric: [cpu-load.-1]
+type fileConfig struct {
+	// flags maps flag names to their values and the node they were read from
+	flags       map[string]flagConfig
+	coturn      []coturnConfig
+	httpMetrics []httpMetricsConfig
+	// filters maps stat names to the metrics that are kept
+	filters map[string]filterConfig
+}
+
+type flagConfig struct {
+	values []string
+	node   *yaml.Node
+}
+
+// filterConfig selects metrics by glob pattern or regular expression
+type filterConfig struct {
+	metric []string
+	regex  []string
+}
+
+type coturnConfig struct {
+	name     string
+	host     string
+	port     int
+	password string
+	interval time.Duration
+	timeout  time.Duration
+	filter   filterConfig
+}
+
+type httpMetricsConfig struct {
+	name     string
+	url      string
+	prefix   string
+	interval time.Duration
+	timeout  time.Duration
+	filter   filterConfig
+}
+
+// loadConfigFile reads and validates the config file at path
+func loadConfigFile(path string) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return config, nil
+}
+
+// parseConfig parses and validates a config file
+func parseConfig(b []byte) (*fileConfig, error) {
+	config := &fileConfig{
+		flags:   make(map[string]flagConfig),
+		filters: make(map[string]filterConfig),
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(b, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		// Empty file
+		return config, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, newConfigError(root, "config", "expected a mapping of settings")
+	}
+	err := eachKey(root, "", func(key string, value *yaml.Node) error {
+		switch key {
+		case "coturn":
+			seen := make(map[string]bool)
+			return eachItem(value, key, func(key string, item *yaml.Node) error {
+				c, err := parseCoturnConfig(key, item)
+				config.coturn = append(config.coturn, c)
+				if err != nil {
+					return err
+				}
+				return validateInstanceName(seen, key, item, c.name)
+			})
+		case "http-metrics":
+			seen := make(map[string]bool)
+			return eachItem(value, key, func(key string, item *yaml.Node) error {
+				c, err := parseHTTPMetricsConfig(key, item)
+				config.httpMetrics = append(config.httpMetrics, c)
+				if err != nil {
+					return err
+				}
+				return validateInstanceName(seen, key, item, c.name)
+			})
+		case "filters":
+			return eachKey(value, key, func(stat string, node *yaml.Node) error {
+				filter, err := parseFilterConfig(fmt.Sprintf("%v.%v", key, stat), node)
+				config.filters[stat] = filter
+				return err
+			})
+		}
+		if !configurable(key) {
+			return newConfigError(value, key, "unknown setting")
+		}
+		values, err := flagValues(key, value)
+		if err != nil {
+			return err
+		}
+		config.flags[key] = flagConfig{values, value}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validateInstanceName checks that no earlier item of the list, whose names
+// are in seen, has the same name as item
+func validateInstanceName(seen map[string]bool, key string, item *yaml.Node, name string) error {
+	if seen[name] {
+		return newConfigError(item, key+".name", "%q is used by another instance", name)
+	}
+	seen[name] = true
+	return nil
+}
+
+// flagValues returns the values that the node sets the flag to. Flags that can
+// be repeated accept lists, and otlp-header accepts a mapping of headers.
+func flagValues(key string, node *yaml.Node) ([]string, error) {
+	_, cumulative := cumulativeFlags[key]
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		if !cumulative {
+			return nil, newConfigError(node, key, "expected a single value")
+		}
+		return scalars(key, node)
+	case yaml.MappingNode:
+		if key != "otlp-header" {
+			return nil, newConfigError(node, key, "expected a single value")
+		}
+		values := make([]string, 0)
+		err := eachKey(node, key, func(header string, value *yaml.Node) error {
+			if value.Kind != yaml.ScalarNode {
+				return newConfigError(value, fmt.Sprintf("%v.%v", key, header), "expected a single value")
+			}
+			values = append(values, fmt.Sprintf("%v=%v", header, value.Value))
+			return nil
+		})
+		return values, err
+	}
+	return nil, newConfigError(node, key, "unexpected value")
+}
+
+func parseCoturnConfig(key string, node *yaml.Node) (coturnConfig, error) {
+	c := coturnConfig{port: 5558}
+	err := eachKey(node, key, func(field string, value *yaml.Node) error {
+		fieldKey := fmt.Sprintf("%v.%v", key, field)
+		switch field {
+		case "name":
+			return decodeScalar(fieldKey, value, &c.name)
+		case "host":
+			return decodeScalar(fieldKey, value, &c.host)
+		case "port":
+			return decodeScalar(fieldKey, value, &c.port)
+		case "password":
+			return decodeScalar(fieldKey, value, &c.password)
+		case "interval":
+			return decodeDuration(fieldKey, value, &c.interval)
+		case "timeout":
+			return decodeDuration(fieldKey, value, &c.timeout)
+		case "metric":
+			return decodeList(fieldKey, value, &c.filter.metric)
+		case "regex":
+			return decodeList(fieldKey, value, &c.filter.regex)
+		}
+		return newConfigError(value, fieldKey, "unknown setting")
+	})
+	if err != nil {
+		return c, err
+	}
+	if !instanceName.MatchString(c.name) {
+		return c, newConfigError(node, key+".name", "must be made of letters, digits, - and _")
+	}
+	if c.host == "" {
+		return c, newConfigError(node, key+".host", "is required")
+	}
+	if c.port < 1 || c.port > 65535 {
+		return c, newConfigError(node, key+".port", "must be between 1 and 65535")
+	}
+	return c, validateFilter(key, node, c.filter)
+}
+
+func parseHTTPMetricsConfig(key string, node *yaml.Node) (httpMetricsConfig, error) {
+	c := httpMetricsConfig{}
+	err := eachKey(node, key, func(field string, value *yaml.Node) error {
+		fieldKey := fmt.Sprintf("%v.%v", key, field)
+		switch field {
+		case "name":
+			return decodeScalar(fieldKey, value, &c.name)
+		case "url":
+			return decodeScalar(fieldKey, value, &c.url)
+		case "prefix":
+			return decodeScalar(fieldKey, value, &c.prefix)
+		case "interval":
+			return decodeDuration(fieldKey, value, &c.interval)
+		case "timeout":
+			return decodeDuration(fieldKey, value, &c.timeout)
+		case "metric":
+			return decodeList(fieldKey, value, &c.filter.metric)
+		case "regex":
+			return decodeList(fieldKey, value, &c.filter.regex)
+		}
+		return newConfigError(value, fieldKey, "unknown setting")
+	})
+	if err != nil {
+		return c, err
+	}
+	if !instanceName.MatchString(c.name) {
+		return c, newConfigError(node, key+".name", "must be made of letters, digits, - and _")
+	}
+	if u, err := url.Parse(c.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c, newConfigError(node, key+".url", "must be an http or https URL")
+	}
+	return c, validateFilter(key, node, c.filter)
+}
+
+func parseFilterConfig(key string, node *yaml.Node) (filterConfig, error) {
+	filter := filterConfig{}
+	err := eachKey(node, key, func(field string, value *yaml.Node) error {
+		fieldKey := fmt.Sprintf("%v.%v", key, field)
+		switch field {
+		case "metric":
+			return decodeList(fieldKey, value, &filter.metric)
+		case "regex":
+			return decodeList(fieldKey, value, &filter.regex)
+		}
+		return newConfigError(value, fieldKey, "unknown setting")
+	})
+	if err != nil {
+		return filter, err
+	}
+	return filter, validateFilter(key, node, filter)
+}
+
+// validateFilter checks that the filter's patterns and expressions compile
+func validateFilter(key string, node *yaml.Node, filter filterConfig) error {
+	for _, pattern := range filter.metric {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return newConfigError(node, key+".metric", "invalid pattern %q", pattern)
+		}
+	}
+	for _, expression := range filter.regex {
+		if _, err := regexp.Compile(expression); err != nil {
+			return newConfigError(node, key+".regex", "invalid regular expression %q: %v", expression, err)
+		}
+	}
+	return nil
+}
+
+// eachKey calls fn with every key and value of a mapping node, in order
+func eachKey(node *yaml.Node, key string, fn func(key string, value *yaml.Node) error) error {
+	if node.Kind != yaml.MappingNode {
+		return newConfigError(node, key, "expected a mapping")
+	}
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		if err := fn(node.Content[idx].Value, node.Content[idx+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachItem calls fn with every item of a sequence node
+func eachItem(node *yaml.Node, key string, fn func(key string, item *yaml.Node) error) error {
+	if node.Kind != yaml.SequenceNode {
+		return newConfigError(node, key, "expected a list")
+	}
+	for idx, item := range node.Content {
+		if err := fn(fmt.Sprintf("%v[%d]", key, idx), item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeScalar(key string, node *yaml.Node, out interface{}) error {
+	if node.Kind != yaml.ScalarNode {
+		return newConfigError(node, key, "expected a single value")
+	}
+	if err := node.Decode(out); err != nil {
+		return newConfigError(node, key, "invalid value %q", node.Value)
+	}
+	return nil
+}
+
+func decodeDuration(key string, node *yaml.Node, out *time.Duration) error {
+	var value string
+	if err := decodeScalar(key, node, &value); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return newConfigError(node, key, "invalid duration %q", value)
+	}
+	*out = d
+	return nil
+}
+
+// decodeList decodes a list of strings, or a single string
+func decodeList(key string, node *yaml.Node, out *[]string) error {
+	if node.Kind == yaml.ScalarNode {
+		*out = []string{node.Value}
+		return nil
+	}
+	values, err := scalars(key, node)
+	*out = values
+	return err
+}
+
+func scalars(key string, node *yaml.Node) ([]string, error) {
+	values := make([]string, 0, len(node.Content))
+	err := eachItem(node, key, func(key string, item *yaml.Node) error {
+		if item.Kind != yaml.ScalarNode {
+			return newConfigError(item, key, "expected a single value")
+		}
+		values = append(values, item.Value)
+		return nil
+	})
+	return values, err
+}
+
+// commandLineFlags returns the names of the flags given in args
+func commandLineFlags(args []string) map[string]bool {
+	names := make(map[string]bool)
+	context, err := kingpin.CommandLine.ParseContext(args)
+	if err != nil {
+		return names
+	}
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			names[flag.Model().Name] = true
+		}
+	}
+	return names
+}
+
+// applyConfig sets every flag that was neither given on the command line nor
+// through its environment variable to its value in config, or to its default
+// if config does not set it. A nil config resets those flags to their
+// defaults. Flags may have been partially updated if an error is returned.
+func applyConfig(config *fileConfig, cli map[string]bool) error {
+	if config == nil {
+		config = &fileConfig{}
+	}
+	flags := kingpin.CommandLine.Model().Flags
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].Name < flags[j].Name
+	})
+	for _, flag := range flags {
+		env := flagEnvVars[flag.Name]
+		if !configurable(flag.Name) || cli[flag.Name] || (env != "" && os.Getenv(env) != "") {
+			continue
+		}
+		// Without an environment variable the default is the built-in one
+		values := flag.Default
+		fileValue, inFile := config.flags[flag.Name]
+		if inFile {
+			values = fileValue.values
+		}
+		if reset, ok := cumulativeFlags[flag.Name]; ok {
+			reset()
+		}
+		for _, value := range values {
+			if err := flag.Value.Set(value); err != nil {
+				if inFile {
+					return newConfigError(fileValue.node, flag.Name, "%v", err)
+				}
+				return fmt.Errorf("%v: %v", flag.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configurable reports whether the config file can set the flag
+func configurable(name string) bool {
+	return !notInConfig[name] && kingpin.CommandLine.GetFlag(name) != nil
+}
+
+// flagValueStrings returns the current values of the flags
+func flagValueStrings(names []string) map[string]string {
+	values := make(map[string]string, len(names))
+	for _, flag := range kingpin.CommandLine.Model().Flags {
+		for _, name := range names {
+			if flag.Name == name {
+				values[name] = flag.Value.String()
+			}
+		}
+	}
+	return values
+}
+
+// changedFlags returns the flags whose values differ
+func changedFlags(before map[string]string, after map[string]string) []string {
+	changed := make([]string, 0)
+	for name, value := range before {
+		if after[name] != value {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// filterFor returns the filter that the config applies to the stat, if any
+func (c *fileConfig) filterFor(stat string) (filterConfig, bool) {
+	if c == nil {
+		return filterConfig{}, false
+	}
+	filter, ok := c.filters[stat]
+	return filter, ok
+}
+
+// describe summarizes the config for logging
+func (c *fileConfig) describe() string {
+	if c == nil {
+		return "no config file"
+	}
+	names := make([]string, 0, len(c.flags))
+	for name := range c.flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%d settings (%v), %d coturn and %d HTTP instances, %d filters",
+		len(names), strings.Join(names, ", "), len(c.coturn), len(c.httpMetrics), len(c.filters))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestConfigFlagsAreKnown(t *testing.T) {
+	require := require.New(t)
+
+	for _, flag := range kingpin.CommandLine.Model().Flags {
+		require.Equal(!notInConfig[flag.Name], configurable(flag.Name), flag.Name)
+	}
+	require.False(configurable("unknown"))
+	envs := make(map[string]string)
+	for name, env := range flagEnvVars {
+		require.NotNil(kingpin.CommandLine.GetFlag(name), name)
+		require.NotContains(envs, env, "%v is also used by --%v", env, envs[env])
+		envs[env] = name
+	}
+	for name := range cumulativeFlags {
+		require.True(configurable(name), name)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	require := require.New(t)
+
+	config, err := parseConfig([]byte(`
+statsd-interval: 500
+sink: [log, prometheus]
+otlp-header:
+  Authorization: Bearer token
+coturn:
+  - name: edge
+    host: 10.0.0.2
+    password: secret
+    interval: 10s
+    metric: coturn.edge.numSessions
+http-metrics:
+  - name: app
+    url: http://localhost:8080/metrics
+    prefix: app
+    timeout: 2s
+    regex: ['^app\.requests']
+filters:
+  cpu-load-stat:
+    metric: [cpu-load.-1]
+`))
+	require.Nil(err)
+	require.Equal([]string{"500"}, config.flags["statsd-interval"].values)
+	require.Equal([]string{"log", "prometheus"}, config.flags["sink"].values)
+	require.Equal([]string{"Authorization=Bearer token"}, config.flags["otlp-header"].values)
+	require.Equal([]coturnConfig{{
+		name:     "edge",
+		host:     "10.0.0.2",
+		port:     5558,
+		password: "secret",
+		interval: 10 * time.Second,
+		filter:   filterConfig{metric: []string{"coturn.edge.numSessions"}},
+	}}, config.coturn)
+	require.Equal([]httpMetricsConfig{{
+		name:    "app",
+		url:     "http://localhost:8080/metrics",
+		prefix:  "app",
+		timeout: 2 * time.Second,
+		filter:  filterConfig{regex: []string{`^app\.requests`}},
+	}}, config.httpMetrics)
+	require.Equal(map[string]filterConfig{
+		"cpu-load-stat": {metric: []string{"cpu-load.-1"}},
+	}, config.filters)
+
+	// An empty file is valid
+	config, err = parseConfig([]byte(""))
+	require.Nil(err)
+	require.Empty(config.flags)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	require := require.New(t)
+
+	for config, expected := range map[string]string{
+		"statsd-intervall: 500":                                   "line 1: statsd-intervall: unknown setting",
+		"statsd-interval: [1, 2]":                                 "line 1: statsd-interval: expected a single value",
+		"- statsd-interval":                                       "line 1: config: expected a mapping of settings",
+		"sink: log\ncoturn:\n  - name: a\n    hots: x":            "line 4: coturn[0].hots: unknown setting",
+		"coturn:\n  - name: a b\n    host: x":                     "line 2: coturn[0].name: must be made of letters, digits, - and _",
+		"coturn:\n  - name: a":                                    "line 2: coturn[0].host: is required",
+		"coturn:\n  - name: a\n    host: x\n    interval: soon":   "line 4: coturn[0].interval: invalid duration \"soon\"",
+		"coturn:\n  - {name: a, host: x}\n  - {name: a, host: y}": "line 3: coturn[1].name: \"a\" is used by another instance",
+		"http-metrics:\n  - name: a\n    url: localhost":          "line 2: http-metrics[0].url: must be an http or https URL",
+		"filters:\n  cpu-load-stat:\n    regex: '('":              "line 3: filters.cpu-load-stat.regex: invalid regular expression",
+		"filters:\n  cpu-load-stat:\n    metric: '['":             "line 3: filters.cpu-load-stat.metric: invalid pattern",
+	} {
+		_, err := parseConfig([]byte(config))
+		require.Error(err, config)
+		require.Contains(err.Error(), expected, config)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "machinestatsd-config")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	require.Nil(ioutil.WriteFile(path, []byte("statsd-prefix: [a]\n"), 0644))
+
+	_, err = loadConfigFile(path)
+	require.EqualError(err, path+": line 1: statsd-prefix: expected a single value")
+
+	_, err = loadConfigFile(filepath.Join(dir, "missing.yaml"))
+	require.Error(err)
+}
+
+func TestApplyConfig(t *testing.T) {
+	require := require.New(t)
+	defer applyConfig(nil, nil)
+
+	os.Setenv("MACHINESTATSD_READY_MAX_ERRORS", "7")
+	defer os.Unsetenv("MACHINESTATSD_READY_MAX_ERRORS")
+	*readyMaxErrors = 7
+
+	config, err := parseConfig([]byte(`
+statsd-interval: 500
+statsd-prefix: file
+sink: [log, graphite]
+ready-max-errors: 1
+otlp-header:
+  A: b
+`))
+	require.Nil(err)
+	cli := commandLineFlags([]string{"--statsd-prefix", "cli"})
+	require.Equal(map[string]bool{"statsd-prefix": true}, cli)
+	*prefix = "cli"
+
+	require.Nil(applyConfig(config, cli))
+	require.Equal(500, *interval)
+	// The command line and environment take precedence over the file
+	require.Equal("cli", *prefix)
+	require.Equal(7, *readyMaxErrors)
+	// Repeatable flags are replaced rather than added to
+	require.Equal([]string{"log", "graphite"}, *sinkNames)
+	require.Equal(map[string]string{"A": "b"}, *otlpHeaders)
+	// Settings that the file does not have go back to their defaults
+	require.Equal("/proc", *procFSPath)
+
+	// Removing a setting from the file restores its default
+	require.Nil(applyConfig(&fileConfig{}, cli))
+	require.Equal(3000, *interval)
+	require.Equal([]string{"statsd", "prometheus"}, *sinkNames)
+	require.Empty(*otlpHeaders)
+	// Probes can check health and readiness without credentials
+	require.Equal([]string{"/healthz", "/readyz"}, *publicPath)
+
+	config, err = parseConfig([]byte("statsd-interval: often\n"))
+	require.Nil(err)
+	err = applyConfig(config, cli)
+	require.Error(err)
+	require.Contains(err.Error(), "line 1: statsd-interval:")
+}
+
+func TestChangedFlags(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal([]string{"a", "c"}, changedFlags(
+		map[string]string{"a": "1", "b": "2", "c": "3"},
+		map[string]string{"a": "2", "b": "2", "c": ""},
+	))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	machinestats "github.com/gurupras/go-machinestats"
+	log "github.com/sirupsen/logrus"
+)
+
+// daemon holds what is rebuilt when the config is reloaded
+type daemon struct {
+	// mutex serializes reloads and shutdown
+	mutex      sync.Mutex
+	configPath string
+	// cli are the flags given on the command line, which the config file does
+	// not override
+	cli map[string]bool
+	// config is the config file that was applied last, nil without one
+	config    *fileConfig
+	ip        string
+	collector *machinestats.Collector
+	// core are the machine stats, which are kept across reloads since they
+	// measure the difference between consecutive readings
+	core     []machinestats.Stat
+	selfStat machinestats.Stat
+	// shared are the sinks that serve HTTP clients and outlive reloads
+	shared []machinestats.Sink
+	// sink is the collector's current sink
+	sink       machinestats.Sink
+	registered []string
+	metrics    *swappableHandler
+	ready      *swappableHandler
+}
+
+// sharedSink keeps a sink open when the sink it is part of is closed, leaving
+// that to shutdown
+type sharedSink struct {
+	machinestats.Sink
+}
+
+// Close does nothing
+func (s sharedSink) Close() error {
+	return nil
+}
+
+// swappableHandler serves the handler that was set last, or 404 if there is
+// none
+type swappableHandler struct {
+	mutex   sync.RWMutex
+	handler http.Handler
+}
+
+func (s *swappableHandler) set(handler http.Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handler = handler
+}
+
+func (s *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	handler := s.handler
+	s.mutex.RUnlock()
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// newReloadHandler returns a handler that reloads the config on POST. Why a
+// reload failed is only logged, since config errors quote the file.
+func newReloadHandler(d *daemon) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := d.reload(); err != nil {
+			log.Errorf("Failed to reload config: %v\n", err)
+			http.Error(w, "failed to reload config, see the log for details", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// buildStats returns the stats that the flags and config enable, with the
+// config's filters applied
+func (d *daemon) buildStats(config *fileConfig) ([]scheduledStat, error) {
+	stats := []scheduledStat{
+		{d.core[0], statOptions(*netstatInterval, 0)},
+		{d.core[1], statOptions(*cpuInterval, 0)},
+		{d.core[2], statOptions(*memoryInterval, 0)},
+		{d.core[3], statOptions(*bandwidthInterval, 0)},
+	}
+
+	if *enableCoturn {
+		coturnStat, err := machinestats.NewCoturnStat(*coturnHost, *coturnPort, *coturnPassword)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create coturnStat: %w", err)
+		}
+		stats = append(stats, scheduledStat{coturnStat, statOptions(*coturnInterval, *coturnTimeout)})
+	}
+
+	if *httpMetricsURL != "" {
+		httpStat := machinestats.NewHTTPStat("http-metrics", *httpMetricsURL, *httpMetricsPrefix)
+		stats = append(stats, scheduledStat{httpStat, statOptions(*httpMetricsInterval, *httpMetricsTimeout)})
+	}
+
+	if config != nil {
+		for _, c := range config.coturn {
+			coturnStat, err := machinestats.NewNamedCoturnStat(c.name, c.host, c.port, c.password)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create coturnStat %v: %w", c.name, err)
+			}
+			stat, err := machinestats.NewFilteredStat(coturnStat, c.filter.metric, c.filter.regex)
+			if err != nil {
+				return nil, err
+			}
+			stats = append(stats, scheduledStat{stat, statOptions(orDefault(c.interval, *coturnInterval), orDefault(c.timeout, *coturnTimeout))})
+		}
+		for _, c := range config.httpMetrics {
+			httpStat := machinestats.NewHTTPStat(fmt.Sprintf("http-metrics.%v", c.name), c.url, c.prefix)
+			stat, err := machinestats.NewFilteredStat(httpStat, c.filter.metric, c.filter.regex)
+			if err != nil {
+				return nil, err
+			}
+			stats = append(stats, scheduledStat{stat, statOptions(orDefault(c.interval, *httpMetricsInterval), orDefault(c.timeout, *httpMetricsTimeout))})
+		}
+	}
+
+	names := make(map[string]bool, len(stats))
+	for idx, s := range stats {
+		name := s.stat.Name()
+		if names[name] {
+			return nil, fmt.Errorf("more than one stat is named %v", name)
+		}
+		names[name] = true
+		if filter, ok := config.filterFor(name); ok {
+			stat, err := machinestats.NewFilteredStat(s.stat, filter.metric, filter.regex)
+			if err != nil {
+				return nil, err
+			}
+			stats[idx].stat = stat
+		}
+	}
+	if config != nil {
+		for name := range config.filters {
+			if !names[name] {
+				log.Warnf("Config has a filter for %v, which is not enabled\n", name)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// orDefault returns value, or fallback if value is 0
+func orDefault(value time.Duration, fallback time.Duration) time.Duration {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+// install replaces the collector's sink with new sinks built from the flags
+// and swaps the stats it collects for stats
+func (d *daemon) install(stats []scheduledStat) error {
+	var sinkStats []machinestats.Stat
+	var exporter http.Handler
+	created := false
+	err := d.collector.ReplaceSink(func() (machinestats.Sink, error) {
+		sink, s, e, err := setupSinks(metricPrefix(d.ip), d.ip, stats, d.shared)
+		if err != nil {
+			// Like the collector, go on without a sink
+			d.sink = machinestats.NewMultiSink()
+			return nil, err
+		}
+		d.sink, sinkStats, exporter, created = sink, s, e, true
+		return sink, nil
+	})
+	if err != nil && !created {
+		return err
+	}
+	if err != nil {
+		log.Errorf("%v\n", err)
+	}
+
+	d.collector.Unregister(d.registered...)
+	registered := make([]string, 0, len(stats)+len(sinkStats)+1)
+	for _, s := range stats {
+		d.collector.RegisterWithOptions(s.options, s.stat)
+		registered = append(registered, s.stat.Name())
+	}
+	for _, s := range sinkStats {
+		registered = append(registered, s.Name())
+	}
+	d.collector.RegisterWithOptions(statOptions(0, 0), sinkStats...)
+	if *selfStats {
+		d.collector.RegisterWithOptions(statOptions(0, 0), d.selfStat)
+		registered = append(registered, d.selfStat.Name())
+	}
+	d.registered = registered
+	d.collector.SetWorkers(*workers)
+
+	d.metrics.set(exporter)
+	d.ready.set(machinestats.NewReadyHandler(d.collector, machinestats.ReadinessConfig{
+		StaleIntervals: *readyStaleIntervals,
+		RequiredStats:  *readyRequiredStats,
+		MaxErrors:      *readyMaxErrors,
+	}))
+	return nil
+}
+
+// reload loads the config file again and applies it. If the config is invalid
+// or the stats or sinks cannot be created, the previous config is restored
+// and keeps running.
+func (d *daemon) reload() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.configPath == "" {
+		return fmt.Errorf("no config file was given with --config")
+	}
+	config, err := loadConfigFile(d.configPath)
+	if err != nil {
+		return err
+	}
+	before := flagValueStrings(restartFlags)
+	if err := applyConfig(config, d.cli); err != nil {
+		d.restore(false)
+		return err
+	}
+	stats, err := d.buildStats(config)
+	if err != nil {
+		d.restore(false)
+		return err
+	}
+	if err := d.install(stats); err != nil {
+		// The previous sinks were closed already
+		d.restore(true)
+		return err
+	}
+	d.config = config
+	setLogLevel()
+	for _, name := range changedFlags(before, flagValueStrings(restartFlags)) {
+		log.Warnf("--%v changed, which takes effect after a restart\n", name)
+	}
+	log.Infof("Reloaded %v: %v\n", d.configPath, config.describe())
+	return nil
+}
+
+// restore sets the flags back to the config that was applied last and, if
+// rebuild is set, creates its stats and sinks again
+func (d *daemon) restore(rebuild bool) {
+	if err := applyConfig(d.config, d.cli); err != nil {
+		log.Errorf("Failed to restore the previous config: %v\n", err)
+		return
+	}
+	if !rebuild {
+		return
+	}
+	stats, err := d.buildStats(d.config)
+	if err == nil {
+		err = d.install(stats)
+	}
+	if err != nil {
+		log.Errorf("Failed to restore the previous config, nothing is being sent: %v\n", err)
+	}
+}
+
+// shutdown stops the collector, letting the cycle in progress finish within
+// --shutdown-timeout, delivers everything the sinks still hold and stops the
+// HTTP server. Sinks are closed first so that streaming clients are
+// disconnected. It returns the exit code of the process, which is non-zero if
+// any of the steps failed.
+func (d *daemon) shutdown(stop func() error) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	code := 0
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := d.collector.Shutdown(ctx); err != nil {
+		log.Errorf("Collections did not finish within %v: %v\n", *shutdownTimeout, err)
+		code = 1
+	}
+	sinks := append([]machinestats.Sink{d.sink}, d.shared...)
+	if err := machinestats.NewMultiSink(sinks...).Close(); err != nil {
+		log.Errorf("Failed to flush and close sinks: %v\n", err)
+		code = 1
+	}
+	if err := stop(); err != nil {
+		log.Errorf("Failed to stop HTTP server: %v\n", err)
+		code = 1
+	}
+	if code == 0 {
+		log.Infof("Shut down cleanly\n")
+	}
+	return code
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	machinestats "github.com/gurupras/go-machinestats"
+	"github.com/stretchr/testify/require"
+)
+
+// idleStat is a stat that measures nothing
+type idleStat struct {
+	name string
+}
+
+func (s idleStat) Name() string {
+	return s.name
+}
+
+func (s idleStat) Measure(chan<- machinestats.Measurement) error {
+	return nil
+}
+
+// hungStat blocks in Measure until release is closed
+type hungStat struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s hungStat) Name() string {
+	return "hung"
+}
+
+func (s hungStat) Measure(chan<- machinestats.Measurement) error {
+	close(s.started)
+	<-s.release
+	return nil
+}
+
+// newTestDaemon starts a daemon like main does, with stats that measure
+// nothing in place of the machine stats
+func newTestDaemon(require *require.Assertions, configPath string) *daemon {
+	config, err := loadConfigFile(configPath)
+	require.Nil(err)
+	require.Nil(applyConfig(config, nil))
+	d := &daemon{
+		configPath: configPath,
+		config:     config,
+		ip:         "127.0.0.1",
+		core:       []machinestats.Stat{idleStat{"netstat"}, idleStat{"cpu"}, idleStat{"memory"}, idleStat{"bandwidth"}},
+		selfStat:   idleStat{"machinestatsd"},
+		metrics:    &swappableHandler{},
+		ready:      &swappableHandler{},
+	}
+	d.collector = machinestats.NewCollector(time.Second, machinestats.NewMultiSink())
+	stats, err := d.buildStats(config)
+	require.Nil(err)
+	require.Nil(d.install(stats))
+	return d
+}
+
+// lines returns the lines of the file at path
+func lines(require *require.Assertions, path string) []string {
+	b, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestDaemonReload(t *testing.T) {
+	require := require.New(t)
+	defer applyConfig(nil, nil)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"requests": 3}`)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.yaml")
+	writeConfig := func(file string, app string) {
+		config := fmt.Sprintf("sink: file\nfile-path: %v\nhttp-metrics:\n  - {name: %v, url: '%v', prefix: %v}\n", filepath.Join(dir, file), app, server.URL, app)
+		require.Nil(ioutil.WriteFile(configPath, []byte(config), 0644))
+	}
+
+	writeConfig("first.jsonl", "first")
+	d := newTestDaemon(require, configPath)
+	defer d.shutdown(func() error { return nil })
+	d.collector.Collect()
+	require.Contains(d.registered, "http-metrics.first")
+
+	// A reload swaps both the stats and the sinks
+	writeConfig("second.jsonl", "second")
+	w := httptest.NewRecorder()
+	newReloadHandler(d).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.NotContains(d.registered, "http-metrics.first")
+	require.Contains(d.registered, "http-metrics.second")
+	d.collector.Collect()
+	first := lines(require, filepath.Join(dir, "first.jsonl"))
+	require.Len(first, 1)
+	require.Contains(first[0], `"first.requests":3`)
+	second := lines(require, filepath.Join(dir, "second.jsonl"))
+	require.Len(second, 1)
+	require.Contains(second[0], `"second.requests":3`)
+	require.NotContains(second[0], "first")
+	config := d.config
+
+	// An invalid file leaves the running config alone
+	require.Nil(ioutil.WriteFile(configPath, []byte("statsd-interval: often\n"), 0644))
+	require.Error(d.reload())
+	require.True(config == d.config)
+	require.Equal(filepath.Join(dir, "second.jsonl"), *filePath)
+	require.Contains(d.registered, "http-metrics.second")
+
+	// So does a file whose sinks cannot be created, after the previous sinks
+	// are created again
+	writeConfig(filepath.Join("missing", "third.jsonl"), "third")
+	err = d.reload()
+	require.Error(err)
+	require.Contains(err.Error(), "failed to create file sink")
+	require.True(config == d.config)
+	require.Equal(filepath.Join(dir, "second.jsonl"), *filePath)
+	require.NotContains(d.registered, "http-metrics.third")
+	require.Contains(d.registered, "http-metrics.second")
+	d.collector.Collect()
+	require.Len(lines(require, filepath.Join(dir, "second.jsonl")), 2)
+}
+
+func TestReloadHandler(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.yaml")
+	require.Nil(ioutil.WriteFile(configPath, []byte("coturn-password: [hunter2]\n"), 0644))
+	handler := newReloadHandler(&daemon{configPath: configPath})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/reload", nil))
+	require.Equal(http.StatusMethodNotAllowed, w.Code)
+	require.Equal(http.MethodPost, w.Header().Get("Allow"))
+
+	// Why the config is invalid is not given away
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/-/reload", nil))
+	require.Equal(http.StatusInternalServerError, w.Code)
+	require.NotContains(w.Body.String(), "hunter2")
+	require.NotContains(w.Body.String(), configPath)
+}
+
+func TestDaemonShutdown(t *testing.T) {
+	require := require.New(t)
+	defer applyConfig(nil, nil)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"requests": 3}`)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.yaml")
+	statsPath := filepath.Join(dir, "stats.jsonl")
+	config := fmt.Sprintf("sink: file\nfile-path: %v\naggregate-window: 1h\nshutdown-timeout: 50ms\nhttp-metrics:\n  - {name: app, url: '%v', prefix: app}\n", statsPath, server.URL)
+	require.Nil(ioutil.WriteFile(configPath, []byte(config), 0644))
+
+	// Sinks deliver what they hold when shutting down
+	d := newTestDaemon(require, configPath)
+	d.collector.Collect()
+	b, err := ioutil.ReadFile(statsPath)
+	require.Nil(err)
+	require.Empty(b)
+	require.Equal(0, d.shutdown(func() error { return nil }))
+	stats := lines(require, statsPath)
+	require.Len(stats, 1)
+	require.Contains(stats[0], `"app.requests.mean":3`)
+
+	// Failing to stop the HTTP server is reported
+	d = newTestDaemon(require, configPath)
+	require.Equal(1, d.shutdown(func() error { return fmt.Errorf("boom") }))
+
+	// So is a collection that does not finish in time, without waiting for it
+	stat := hungStat{make(chan struct{}), make(chan struct{})}
+	defer close(stat.release)
+	d = newTestDaemon(require, configPath)
+	d.core[0] = stat
+	scheduled, err := d.buildStats(d.config)
+	require.Nil(err)
+	require.Nil(d.install(scheduled))
+	d.collector.Start(context.Background())
+	<-stat.started
+	start := time.Now()
+	require.Equal(1, d.shutdown(func() error { return nil }))
+	require.True(time.Since(start) < time.Second)
+	// What the other stats measured is still delivered
+	require.Len(lines(require, statsPath), 2)
+}
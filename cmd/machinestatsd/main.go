@@ -1,20 +1,21 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
 	machinestats "github.com/gurupras/go-machinestats"
-	"github.com/gurupras/statsd"
 	"github.com/prometheus/procfs"
 	log "github.com/sirupsen/logrus"
 )
@@ -40,6 +41,28 @@ func getEnv(key, defaultValue string) string {
 	return val
 }
 
+// flagEnvVars maps flag names to the environment variable that sets their
+// default, which also takes precedence over the config file
+var flagEnvVars = make(map[string]string)
+
+// flagEnv records env as the environment variable of the flag and returns its
+// value, or defaultValue if it is not set
+func flagEnv(flag, env, defaultValue string) string {
+	flagEnvVars[flag] = env
+	return getEnv(env, defaultValue)
+}
+
+// splitList splits a comma separated list, ignoring empty entries
+func splitList(value string) []string {
+	result := make([]string, 0)
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
 func initDefaultAllCPUs(ncpu int) string {
 	if ncpu > 1 {
 		return "true"
@@ -49,88 +72,169 @@ func initDefaultAllCPUs(ncpu int) string {
 
 var (
 	numCPUs               = runtime.NumCPU()
-	defaultDebugMode      = getEnv("MACHINESTATSD_DEBUG", "false")
+	defaultDebugMode      = flagEnv("debug", "MACHINESTATSD_DEBUG", "false")
 	defaultAllCpus        = initDefaultAllCPUs(numCPUs)
-	defaultAddress        = getEnv("STATSD_ADDRESS", ":8125")
-	defaultInterval       = getEnv("STATSD_INTERVAL", "3000")
-	defaultPrefix         = getEnv("STATSD_PREFIX", "")
-	defaultPrefixIP       = getEnv("MACHINESTATSD_PREFIX_IP", "false")
-	defaultCoturn         = getEnv("MACHINESTATSD_COTURN_ENABLE", "false")
-	defaultCoturnHost     = getEnv("MACHINESTATSD_COTURN_HOST", "127.0.0.1")
-	defaultCoturnPort     = getEnv("MACHINESTATSD_COTURN_PORT", "5558")
-	defaultCoturnPassword = getEnv("MACHINESTATSD_COTURN_PASSWORD", "")
-	defaultVerbose        = getEnv("MACHINESTATSD_VERBOSE", "false")
-	defaultProcFSPath     = getEnv("MACHINESTATSD_PROCFS_PATH", "/proc")
-	defaultServerPort     = getEnv("MACHINESTATSD_SERVER_PORT", "1122")
-
-	defaultHTTPMetricsURL    = getEnv("MACHINESTATSD_HTTP_METRICS_URL", "")
-	defaultHTTPMetricsPrefix = getEnv("MACHINESTATSD_HTTP_METRICS_PREFIX", "")
+	defaultAddress        = flagEnv("statsd-address", "STATSD_ADDRESS", ":8125")
+	defaultPacketSize     = flagEnv("statsd-max-packet-size", "STATSD_MAX_PACKET_SIZE", "1432")
+	defaultInterval       = flagEnv("statsd-interval", "STATSD_INTERVAL", "3000")
+	defaultPrefix         = flagEnv("statsd-prefix", "STATSD_PREFIX", "")
+	defaultPrefixIP       = flagEnv("prefix-ip", "MACHINESTATSD_PREFIX_IP", "false")
+	defaultCoturn         = flagEnv("enable-coturn", "MACHINESTATSD_COTURN_ENABLE", "false")
+	defaultCoturnHost     = flagEnv("coturn-host", "MACHINESTATSD_COTURN_HOST", "127.0.0.1")
+	defaultCoturnPort     = flagEnv("coturn-port", "MACHINESTATSD_COTURN_PORT", "5558")
+	defaultCoturnPassword = flagEnv("coturn-password", "MACHINESTATSD_COTURN_PASSWORD", "")
+	defaultVerbose        = flagEnv("verbose", "MACHINESTATSD_VERBOSE", "false")
+	defaultProcFSPath     = flagEnv("procfs", "MACHINESTATSD_PROCFS_PATH", "/proc")
+	defaultServerPort     = flagEnv("server-port", "MACHINESTATSD_SERVER_PORT", "1122")
+	defaultBindAddress    = flagEnv("bind-address", "MACHINESTATSD_BIND_ADDRESS", "0.0.0.0")
+	defaultTLSCert        = flagEnv("tls-cert", "MACHINESTATSD_TLS_CERT", "")
+	defaultTLSKey         = flagEnv("tls-key", "MACHINESTATSD_TLS_KEY", "")
+	defaultTLSClientCA    = flagEnv("tls-client-ca", "MACHINESTATSD_TLS_CLIENT_CA", "")
+	defaultAuthTokens     = flagEnv("auth-token", "MACHINESTATSD_AUTH_TOKEN", "")
+	defaultAuthBasic      = flagEnv("auth-basic", "MACHINESTATSD_AUTH_BASIC", "")
+	defaultPublicPaths    = flagEnv("public-path", "MACHINESTATSD_PUBLIC_PATHS", "/healthz,/readyz")
+	defaultPromNamespace  = flagEnv("prometheus-namespace", "MACHINESTATSD_PROMETHEUS_NAMESPACE", "")
+	defaultSinks          = flagEnv("sink", "MACHINESTATSD_SINKS", "statsd,prometheus")
+	defaultInfluxURL      = flagEnv("influx-url", "MACHINESTATSD_INFLUX_URL", "http://localhost:8086")
+	defaultInfluxDatabase = flagEnv("influx-database", "MACHINESTATSD_INFLUX_DATABASE", "machinestats")
+	defaultInfluxOrg      = flagEnv("influx-org", "MACHINESTATSD_INFLUX_ORG", "")
+	defaultInfluxBucket   = flagEnv("influx-bucket", "MACHINESTATSD_INFLUX_BUCKET", "")
+	defaultInfluxToken    = flagEnv("influx-token", "MACHINESTATSD_INFLUX_TOKEN", "")
+	defaultInfluxGzip     = flagEnv("influx-gzip", "MACHINESTATSD_INFLUX_GZIP", "false")
+	defaultInfluxRetries  = flagEnv("influx-retries", "MACHINESTATSD_INFLUX_RETRIES", "3")
+	defaultGraphiteAddr   = flagEnv("graphite-address", "MACHINESTATSD_GRAPHITE_ADDRESS", "localhost:2003")
+	defaultGraphiteBuffer = flagEnv("graphite-buffer", "MACHINESTATSD_GRAPHITE_BUFFER", "10000")
+	defaultOTLPURL        = flagEnv("otlp-url", "MACHINESTATSD_OTLP_URL", "http://localhost:4318/v1/metrics")
+	defaultOTLPEncoding   = flagEnv("otlp-encoding", "MACHINESTATSD_OTLP_ENCODING", "protobuf")
+	defaultFilePath       = flagEnv("file-path", "MACHINESTATSD_FILE_PATH", "machinestatsd.log")
+	defaultFileFormat     = flagEnv("file-format", "MACHINESTATSD_FILE_FORMAT", "json")
+	defaultFileMaxSize    = flagEnv("file-max-size", "MACHINESTATSD_FILE_MAX_SIZE", "100MB")
+	defaultFileMaxAge     = flagEnv("file-max-age", "MACHINESTATSD_FILE_MAX_AGE", "24h")
+	defaultFileCompress   = flagEnv("file-compress", "MACHINESTATSD_FILE_COMPRESS", "false")
+	defaultSpoolDir       = flagEnv("spool-dir", "MACHINESTATSD_SPOOL_DIR", "")
+	defaultSpoolMaxSize   = flagEnv("spool-max-size", "MACHINESTATSD_SPOOL_MAX_SIZE", "64MB")
+
+	defaultCPUInterval         = flagEnv("cpu-interval", "MACHINESTATSD_CPU_INTERVAL", "0s")
+	defaultMemoryInterval      = flagEnv("memory-interval", "MACHINESTATSD_MEMORY_INTERVAL", "0s")
+	defaultNetstatInterval     = flagEnv("netstat-interval", "MACHINESTATSD_NETSTAT_INTERVAL", "0s")
+	defaultBandwidthInterval   = flagEnv("bandwidth-interval", "MACHINESTATSD_BANDWIDTH_INTERVAL", "0s")
+	defaultCoturnInterval      = flagEnv("coturn-interval", "MACHINESTATSD_COTURN_INTERVAL", "0s")
+	defaultHTTPMetricsInterval = flagEnv("http-metrics-interval", "MACHINESTATSD_HTTP_METRICS_INTERVAL", "0s")
+	defaultAggregateWindow     = flagEnv("aggregate-window", "MACHINESTATSD_AGGREGATE_WINDOW", "0s")
+	defaultAggregatePercentile = flagEnv("aggregate-percentiles", "MACHINESTATSD_AGGREGATE_PERCENTILES", "50,95,99")
+	defaultHistoryDuration     = flagEnv("history-duration", "MACHINESTATSD_HISTORY_DURATION", "10m")
+	defaultHistoryPoints       = flagEnv("history-points", "MACHINESTATSD_HISTORY_POINTS", "600")
+	defaultReadyStaleIntervals = flagEnv("ready-stale-intervals", "MACHINESTATSD_READY_STALE_INTERVALS", "3")
+	defaultReadyRequiredStats  = flagEnv("ready-required-stat", "MACHINESTATSD_READY_REQUIRED_STATS", "")
+	defaultReadyMaxErrors      = flagEnv("ready-max-errors", "MACHINESTATSD_READY_MAX_ERRORS", "3")
+	defaultShutdownTimeout     = flagEnv("shutdown-timeout", "MACHINESTATSD_SHUTDOWN_TIMEOUT", "10s")
+	defaultSelfStats           = flagEnv("self-stats", "MACHINESTATSD_SELF_STATS", "true")
+	defaultWorkers             = flagEnv("workers", "MACHINESTATSD_WORKERS", "4")
+	defaultStatTimeout         = flagEnv("stat-timeout", "MACHINESTATSD_STAT_TIMEOUT", "0s")
+	defaultCoturnTimeout       = flagEnv("coturn-timeout", "MACHINESTATSD_COTURN_TIMEOUT", "0s")
+	defaultHTTPMetricsTimeout  = flagEnv("http-metrics-timeout", "MACHINESTATSD_HTTP_METRICS_TIMEOUT", "0s")
+
+	defaultConfigFile        = flagEnv("config", "MACHINESTATSD_CONFIG", "")
+	defaultReloadEndpoint    = flagEnv("reload-endpoint", "MACHINESTATSD_RELOAD_ENDPOINT", "false")
+	defaultHTTPMetricsURL    = flagEnv("http-metrics-url", "MACHINESTATSD_HTTP_METRICS_URL", "")
+	defaultHTTPMetricsPrefix = flagEnv("http-metrics-prefix", "MACHINESTATSD_HTTP_METRICS_PREFIX", "")
+
+	configFile     = kingpin.Flag("config", "YAML file with settings and collectors. Flags and environment variables take precedence over it. Reloaded on SIGHUP or, with --reload-endpoint, POST /-/reload").Short('c').Default(defaultConfigFile).String()
+	reloadEndpoint = kingpin.Flag("reload-endpoint", "Serve POST /-/reload, which reloads --config. Anyone who can reach the HTTP server may use it unless --auth-token or --auth-basic is set").Default(defaultReloadEndpoint).Bool()
 
 	debug      = kingpin.Flag("debug", "Debug mode. Don't sent stats to backend").Short('D').Default(defaultDebugMode).Bool()
 	verbose    = kingpin.Flag("verbose", "Verbose logs").Short('v').Default(defaultVerbose).Bool()
 	allCPUs    = kingpin.Flag("all-cpus", "Log each individual CPU").Short('C').Default(defaultAllCpus).Bool()
-	address    = kingpin.Flag("statsd-address", "Statsd server address").Short('a').Default(defaultAddress).String()
+	address    = kingpin.Flag("statsd-address", "Statsd server address. Prefix with tcp:// or unixgram:// to use those transports instead of UDP").Short('a').Default(defaultAddress).String()
+	packetSize = kingpin.Flag("statsd-max-packet-size", "Maximum size of a statsd datagram").Default(defaultPacketSize).Int()
 	interval   = kingpin.Flag("statsd-interval", "Interval at which stats are collected periodically. In milliseconds").Short('d').Default(defaultInterval).Int()
 	prefix     = kingpin.Flag("statsd-prefix", "Prefix with which all metrics are sent").Short('p').Default(defaultPrefix).String()
 	prefixIP   = kingpin.Flag("prefix-ip", "Add IP address as part of prefix").Default(defaultPrefixIP).Bool()
 	procFSPath = kingpin.Flag("procfs", "Path to procfs").Default(defaultProcFSPath).String()
 	serverPort = kingpin.Flag("server-port", "HTTP server port").Short('P').Default(defaultServerPort).Int()
+	bindAddr   = kingpin.Flag("bind-address", "Address the HTTP server listens on").Default(defaultBindAddress).String()
+	tlsCert    = kingpin.Flag("tls-cert", "Certificate file for serving HTTPS. Reloaded when it changes").Default(defaultTLSCert).String()
+	tlsKey     = kingpin.Flag("tls-key", "Key file for serving HTTPS. Reloaded when it changes").Default(defaultTLSKey).String()
+	tlsCA      = kingpin.Flag("tls-client-ca", "CA file that client certificates must be signed by. Enables mutual TLS").Default(defaultTLSClientCA).String()
+	authTokens = kingpin.Flag("auth-token", "Bearer token that grants access to the HTTP server. Can be repeated").Default(splitList(defaultAuthTokens)...).Strings()
+	authBasic  = kingpin.Flag("auth-basic", "USER:PASSWORD that grants access to the HTTP server via basic auth. Can be repeated").Default(splitList(defaultAuthBasic)...).Strings()
+	publicPath = kingpin.Flag("public-path", "HTTP path that is served without authentication. Can be repeated").Default(splitList(defaultPublicPaths)...).Strings()
+	promNS     = kingpin.Flag("prometheus-namespace", "Namespace prepended to metric names on /metrics").Default(defaultPromNamespace).String()
+	sinkNames  = kingpin.Flag("sink", "Output to send measurements to. Can be repeated").Short('s').Default(strings.Split(defaultSinks, ",")...).Enums("statsd", "prometheus", "influx", "graphite", "otlp", "file", "log")
 
 	enableCoturn   = kingpin.Flag("enable-coturn", "Enable stat collection from Coturn instance").Default(defaultCoturn).Bool()
 	coturnHost     = kingpin.Flag("coturn-host", "Coturn server host").Default(defaultCoturnHost).String()
 	coturnPort     = kingpin.Flag("coturn-port", "Coturn server CLI port").Default(defaultCoturnPort).Int()
 	coturnPassword = kingpin.Flag("coturn-password", "Coturn server CLI password").Default(defaultCoturnPassword).String()
 
+	influxURL      = kingpin.Flag("influx-url", "InfluxDB URL. Use udp://host:port for UDP or an http(s) URL ending in /api/v2/write for the v2 API").Default(defaultInfluxURL).String()
+	influxDatabase = kingpin.Flag("influx-database", "InfluxDB database (v1 API)").Default(defaultInfluxDatabase).String()
+	influxOrg      = kingpin.Flag("influx-org", "InfluxDB organization (v2 API)").Default(defaultInfluxOrg).String()
+	influxBucket   = kingpin.Flag("influx-bucket", "InfluxDB bucket (v2 API)").Default(defaultInfluxBucket).String()
+	influxToken    = kingpin.Flag("influx-token", "InfluxDB API token").Default(defaultInfluxToken).String()
+	influxGzip     = kingpin.Flag("influx-gzip", "Gzip InfluxDB HTTP requests").Default(defaultInfluxGzip).Bool()
+	influxRetries  = kingpin.Flag("influx-retries", "Number of later flushes with which a failed InfluxDB write is sent again. Not used with --spool-dir, which retries on its own").Default(defaultInfluxRetries).Int()
+
+	graphiteAddress = kingpin.Flag("graphite-address", "Carbon plaintext listener address").Default(defaultGraphiteAddr).String()
+	graphiteBuffer  = kingpin.Flag("graphite-buffer", "Maximum number of lines buffered while Carbon is unreachable").Default(defaultGraphiteBuffer).Int()
+
+	otlpURL      = kingpin.Flag("otlp-url", "OTLP/HTTP metrics endpoint").Default(defaultOTLPURL).String()
+	otlpEncoding = kingpin.Flag("otlp-encoding", "OTLP request encoding").Default(defaultOTLPEncoding).Enum("protobuf", "json")
+	otlpHeaders  = kingpin.Flag("otlp-header", "Header to send with OTLP requests (KEY=VALUE). Can be repeated").StringMap()
+
+	filePath     = kingpin.Flag("file-path", "File that measurements are recorded to").Default(defaultFilePath).String()
+	fileFormat   = kingpin.Flag("file-format", "Format of the file sink").Default(defaultFileFormat).Enum("json", "csv")
+	fileMaxSize  = kingpin.Flag("file-max-size", "Size after which the file is rotated. 0 disables size based rotation").Default(defaultFileMaxSize).Bytes()
+	fileMaxAge   = kingpin.Flag("file-max-age", "Age after which the file is rotated. 0 disables age based rotation").Default(defaultFileMaxAge).Duration()
+	fileCompress = kingpin.Flag("file-compress", "Gzip rotated files").Default(defaultFileCompress).Bool()
+
+	spoolDir     = kingpin.Flag("spool-dir", "Directory in which measurements that the influx and otlp sinks fail to deliver are spooled and replayed with their original timestamps. statsd is not spooled since it has no timestamps. Disabled if empty").Default(defaultSpoolDir).String()
+	spoolMaxSize = kingpin.Flag("spool-max-size", "Maximum size of each sink's spool").Default(defaultSpoolMaxSize).Bytes()
+
+	cpuInterval         = kingpin.Flag("cpu-interval", "Interval at which CPU load is collected. 0 uses --statsd-interval").Default(defaultCPUInterval).Duration()
+	memoryInterval      = kingpin.Flag("memory-interval", "Interval at which memory load is collected. 0 uses --statsd-interval").Default(defaultMemoryInterval).Duration()
+	netstatInterval     = kingpin.Flag("netstat-interval", "Interval at which network connections are collected. 0 uses --statsd-interval").Default(defaultNetstatInterval).Duration()
+	bandwidthInterval   = kingpin.Flag("bandwidth-interval", "Interval at which network bandwidth is collected. 0 uses --statsd-interval").Default(defaultBandwidthInterval).Duration()
+	coturnInterval      = kingpin.Flag("coturn-interval", "Interval at which Coturn stats are collected. 0 uses --statsd-interval").Default(defaultCoturnInterval).Duration()
+	httpMetricsInterval = kingpin.Flag("http-metrics-interval", "Interval at which metrics are fetched from --http-metrics-url. 0 uses --statsd-interval").Default(defaultHTTPMetricsInterval).Duration()
+	aggregateWindow     = kingpin.Flag("aggregate-window", "Send the min, max, mean and percentiles of every metric once per window instead of every sample. Does not apply to prometheus. 0 disables aggregation").Default(defaultAggregateWindow).Duration()
+	aggregatePercentile = kingpin.Flag("aggregate-percentiles", "Comma separated percentiles reported per aggregation window").Default(defaultAggregatePercentile).String()
+	historyDuration     = kingpin.Flag("history-duration", "Duration for which values are kept in memory and served on /stats/history. 0 disables the history").Default(defaultHistoryDuration).Duration()
+	historyPoints       = kingpin.Flag("history-points", "Maximum number of values kept per metric for /stats/history").Default(defaultHistoryPoints).Int()
+	readyStaleIntervals = kingpin.Flag("ready-stale-intervals", "Number of intervals without a finished collection after which /readyz reports not ready").Default(defaultReadyStaleIntervals).Int()
+	readyRequiredStats  = kingpin.Flag("ready-required-stat", "Stat that must be working for /readyz to report ready. Can be repeated").Default(splitList(defaultReadyRequiredStats)...).Strings()
+	readyMaxErrors      = kingpin.Flag("ready-max-errors", "Number of consecutive failures after which a required stat is considered to be failing").Default(defaultReadyMaxErrors).Int()
+	shutdownTimeout     = kingpin.Flag("shutdown-timeout", "Time that collections in progress are given to finish when shutting down").Default(defaultShutdownTimeout).Duration()
+	selfStats           = kingpin.Flag("self-stats", "Report machinestatsd's own health under machinestatsd.*").Default(defaultSelfStats).Bool()
+	workers             = kingpin.Flag("workers", "Maximum number of stats that are collected at the same time").Default(defaultWorkers).Int()
+	statTimeout         = kingpin.Flag("stat-timeout", "Time after which a stat that has not finished is abandoned. 0 uses half the stat's interval").Default(defaultStatTimeout).Duration()
+	coturnTimeout       = kingpin.Flag("coturn-timeout", "Time after which collecting Coturn stats is abandoned. 0 uses --stat-timeout").Default(defaultCoturnTimeout).Duration()
+	httpMetricsTimeout  = kingpin.Flag("http-metrics-timeout", "Time after which fetching --http-metrics-url is abandoned. 0 uses --stat-timeout").Default(defaultHTTPMetricsTimeout).Duration()
+
 	httpMetricsURL    = kingpin.Flag("http-metrics-url", "URL to fetch metrics from via HTTP").Default(defaultHTTPMetricsURL).String()
 	httpMetricsPrefix = kingpin.Flag("http-metrics-prefix", "Common prefix to apply for each metric retrieved via HTTP").Default(defaultHTTPMetricsPrefix).String()
 )
 
-func asFloat64(input interface{}) float64 {
-	switch val := input.(type) {
-	case float64:
-		return val
-	case int:
-		return float64(val)
-	case int64:
-		return float64(val)
-	case uint64:
-		return float64(val)
-	}
-	return 0
-}
-
 func main() {
 	kingpin.Parse()
-	if *verbose {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+	cli := commandLineFlags(os.Args[1:])
+	var config *fileConfig
+	if *configFile != "" {
+		var err error
+		config, err = loadConfigFile(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v\n", err)
+		}
+		if err := applyConfig(config, cli); err != nil {
+			log.Fatalf("Failed to apply config %v: %v\n", *configFile, err)
+		}
+	}
+	setLogLevel()
+	if config != nil {
+		log.Infof("Loaded %v: %v\n", *configFile, config.describe())
 	}
-
-	addr := statsd.Address(*address)
 
 	ip := GetOutboundIP().String()
-	ipPrefix := strings.ReplaceAll(ip, ".", "-")
-
-	var conn *statsd.Client
-	var err error
-	if !*debug {
-		for {
-			conn, err = statsd.New(
-				addr,
-				// Uncomment these once you figure out how to get Grafana to work with tags
-				// statsd.TagsFormat(statsd.Datadog),
-				// statsd.Tags("ip", ip, "alias", *prefix),
-			)
-			if err != nil {
-				log.Errorf("Failed to set up connection: %v\n", err)
-			} else {
-				break
-			}
-			time.Sleep(1000 * time.Millisecond)
-		}
-		defer conn.Close()
-	}
 
 	fs, _ := procfs.NewFS(*procFSPath)
 
@@ -151,120 +255,317 @@ func main() {
 		log.Fatalf("Failed to create bandwidthStat: %v\n", err)
 	}
 
-	stats := []machinestats.Stat{
-		netstat,
-		cpustat,
-		memstat,
-		bwstat,
+	basicAuth := make(map[string]string)
+	for _, credentials := range *authBasic {
+		idx := strings.Index(credentials, ":")
+		if idx < 0 {
+			log.Fatalf("Invalid --auth-basic, expected USER:PASSWORD\n")
+		}
+		basicAuth[credentials[:idx]] = credentials[idx+1:]
+	}
+	mux, stop, err := machinestats.StartHTTPServerWithConfig(machinestats.HTTPServerConfig{
+		Address:      *bindAddr,
+		Port:         *serverPort,
+		TLSCertFile:  *tlsCert,
+		TLSKeyFile:   *tlsKey,
+		ClientCAFile: *tlsCA,
+		BearerTokens: *authTokens,
+		BasicAuth:    basicAuth,
+		PublicPaths:  *publicPath,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start HTTP server: %v\n", err)
+		os.Exit(-1)
+		return
 	}
 
-	if *enableCoturn {
-		coturnStat, err := machinestats.NewCoturnStat(*coturnHost, *coturnPort, *coturnPassword)
+	d := &daemon{
+		configPath: *configFile,
+		cli:        cli,
+		config:     config,
+		ip:         ip,
+		core:       []machinestats.Stat{netstat, cpustat, memstat, bwstat},
+		metrics:    &swappableHandler{},
+		ready:      &swappableHandler{},
+	}
+	// Clients of /stats/stream see every measurement as it is collected
+	stream := machinestats.NewStatsStream()
+	d.shared = append(d.shared, stream)
+	mux.Handle("/stats/stream", machinestats.NewStatsStreamHandler(stream))
+	if *historyDuration > 0 {
+		// The history keeps the raw values, not the aggregates
+		history, err := machinestats.NewHistory(machinestats.HistoryConfig{
+			Duration: *historyDuration,
+			Points:   *historyPoints,
+		})
 		if err != nil {
-			log.Fatalf("Failed to create coturnStat: %v\n", err)
+			log.Fatalf("Failed to create history: %v\n", err)
 		}
-		stats = append(stats, coturnStat)
+		d.shared = append(d.shared, history)
+		mux.Handle("/stats/history", machinestats.NewStatsHistoryHandler(history))
+	}
+
+	d.collector = machinestats.NewCollector(time.Duration(*interval)*time.Millisecond, machinestats.NewMultiSink())
+	d.selfStat, err = machinestats.NewSelfStat(&fs, d.collector)
+	if err != nil {
+		log.Fatalf("Failed to create selfStat: %v\n", err)
 	}
+	stats, err := d.buildStats(config)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if err := d.install(stats); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	mux.Handle("/stats", machinestats.NewStatsHandler(d.collector))
+	mux.Handle("/stats/metadata", machinestats.NewStatsMetadataHandler(d.collector))
+	mux.Handle("/metrics", d.metrics)
+	mux.Handle("/healthz", machinestats.NewHealthHandler())
+	mux.Handle("/readyz", d.ready)
+	if *reloadEndpoint {
+		mux.Handle("/-/reload", newReloadHandler(d))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	d.collector.Start(context.Background())
+	var sig os.Signal
+	for sig = range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := d.reload(); err != nil {
+			log.Errorf("Failed to reload config: %v\n", err)
+		}
+	}
+	log.Infof("Received %v, shutting down\n", sig)
+	go func() {
+		// A second signal skips the rest of the shutdown
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				log.Errorf("Received %v during shutdown, exiting immediately\n", sig)
+				os.Exit(1)
+			}
+		}
+	}()
+	os.Exit(d.shutdown(stop))
+}
 
-	if *httpMetricsURL != "" {
-		httpStat := machinestats.NewHTTPStat("http-metrics", *httpMetricsURL, *httpMetricsPrefix)
-		stats = append(stats, httpStat)
+// setLogLevel applies --verbose
+func setLogLevel() {
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
 	}
+}
 
+// metricPrefix returns the prefix that --statsd-prefix and --prefix-ip add to
+// every metric
+func metricPrefix(ip string) string {
 	prefixArr := make([]string, 0)
 	if strings.Compare(*prefix, "") != 0 {
 		prefixArr = append(prefixArr, *prefix)
 	}
 	if *prefixIP {
-		prefixArr = append(prefixArr, ipPrefix)
+		prefixArr = append(prefixArr, strings.ReplaceAll(ip, ".", "-"))
 	}
-	finalPrefix := strings.Join(prefixArr, ".")
+	return strings.Join(prefixArr, ".")
+}
 
-	channel := make(chan machinestats.Measurement, 0)
-	go func() {
-		var stat *statsd.Client
-		for measurement := range channel {
-			if !*debug {
-				stat = conn.Clone(
-					statsd.Prefix(finalPrefix),
-				)
-			}
-			name := measurement.Name()
-			statType := measurement.Type()
-			value := measurement.Value()
+// scheduledStat is a stat along with how it is scheduled
+type scheduledStat struct {
+	stat    machinestats.Stat
+	options machinestats.StatOptions
+}
+
+// statOptions returns the options for a stat. An interval of 0 uses
+// --statsd-interval and a timeout of 0 uses --stat-timeout.
+func statOptions(every time.Duration, timeout time.Duration) machinestats.StatOptions {
+	if every <= 0 {
+		// Resolved here rather than by the collector so that a reload can
+		// change it
+		every = time.Duration(*interval) * time.Millisecond
+	}
+	if timeout <= 0 {
+		timeout = *statTimeout
+	}
+	return machinestats.StatOptions{
+		Interval: every,
+		Timeout:  timeout,
+	}
+}
+
+// longestInterval returns the longest interval at which any of the stats is
+// collected
+func longestInterval(stats []scheduledStat) time.Duration {
+	longest := time.Duration(*interval) * time.Millisecond
+	for _, s := range stats {
+		if s.options.Interval > longest {
+			longest = s.options.Interval
+		}
+	}
+	return longest
+}
+
+// setupSinks creates every sink requested via --sink and returns a sink that
+// fans out to all of them and to the shared sinks, along with any stats that
+// the sinks report and the prometheus exporter, if enabled. Nothing is left
+// open if an error is returned.
+func setupSinks(finalPrefix string, ip string, scheduled []scheduledStat, shared []machinestats.Sink) (machinestats.Sink, []machinestats.Stat, http.Handler, error) {
+	hostname, _ := os.Hostname()
+	sinks := make([]machinestats.Sink, 0)
+	// pushSinks are sent measurements, as opposed to prometheus which is
+	// scraped, and are the ones that aggregation applies to
+	pushSinks := make([]machinestats.Sink, 0)
+	stats := make([]machinestats.Stat, 0)
+	var exporter http.Handler
+	// fail closes the sinks created so far, along with any that have not been
+	// added to them yet
+	fail := func(err error, pending ...machinestats.Sink) (machinestats.Sink, []machinestats.Stat, http.Handler, error) {
+		created := append(append(sinks, pushSinks...), pending...)
+		if closeErr := machinestats.NewMultiSink(created...).Close(); closeErr != nil {
+			log.Errorf("Failed to close sinks: %v\n", closeErr)
+		}
+		return nil, nil, nil, err
+	}
+	// spool puts the sink behind a disk spool if one is configured
+	spool := func(name string, sink machinestats.Sink) (machinestats.Sink, error) {
+		if *spoolDir == "" {
+			return sink, nil
+		}
+		spoolSink, err := machinestats.NewSpoolSink(sink, machinestats.SpoolConfig{
+			Name:     name,
+			Dir:      *spoolDir,
+			MaxBytes: int64(*spoolMaxSize),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %v spool: %w", name, err)
+		}
+		stats = append(stats, spoolSink)
+		return spoolSink, nil
+	}
+	for _, name := range *sinkNames {
+		switch name {
+		case "statsd":
 			if *debug {
-				log.Debugf("Logged stat '%v' (%0.2f)\n", name, asFloat64(value))
+				pushSinks = append(pushSinks, machinestats.NewLogSink())
 				continue
 			}
-			switch statType {
-			case machinestats.Gauge:
-				stat.Gauge(name, value)
-				log.Debugf("Logged gauge '%v'\n", name)
-				break
-			case machinestats.Counter:
-				stat.Count(name, value)
-				log.Debugf("Logged counter '%v'\n", name)
-				break
+			statsdSink, err := machinestats.NewStatsdSink(machinestats.StatsdConfig{
+				Address:       *address,
+				Prefix:        finalPrefix,
+				MaxPacketSize: *packetSize,
+			})
+			if err != nil {
+				return fail(fmt.Errorf("failed to create statsd sink: %w", err))
+			}
+			// Not spooled, since statsd has no timestamps that replayed
+			// values could keep
+			pushSinks = append(pushSinks, statsdSink)
+		case "prometheus":
+			prometheus := machinestats.NewPrometheusExporter(*promNS, 2*longestInterval(scheduled))
+			exporter = prometheus
+			sinks = append(sinks, prometheus)
+		case "influx":
+			retries := *influxRetries
+			if *spoolDir != "" {
+				// The spool expects failed lines to be dropped
+				retries = 0
 			}
+			influx, err := machinestats.NewInfluxSink(machinestats.InfluxConfig{
+				URL:        *influxURL,
+				Database:   *influxDatabase,
+				Org:        *influxOrg,
+				Bucket:     *influxBucket,
+				Token:      *influxToken,
+				Gzip:       *influxGzip,
+				MaxRetries: retries,
+				Tags: map[string]string{
+					"host": hostname,
+					"ip":   ip,
+				},
+			})
+			if err != nil {
+				return fail(fmt.Errorf("failed to create influx sink: %w", err))
+			}
+			spooled, err := spool("influx", influx)
+			if err != nil {
+				return fail(err, influx)
+			}
+			pushSinks = append(pushSinks, spooled)
+		case "graphite":
+			pushSinks = append(pushSinks, machinestats.NewGraphiteSink(machinestats.GraphiteConfig{
+				Address:    *graphiteAddress,
+				Prefix:     finalPrefix,
+				BufferSize: *graphiteBuffer,
+			}))
+		case "otlp":
+			otlp, err := machinestats.NewOTLPExporter(machinestats.OTLPConfig{
+				URL:      *otlpURL,
+				Encoding: *otlpEncoding,
+				Headers:  *otlpHeaders,
+				ResourceAttributes: map[string]string{
+					"service.name": "machinestatsd",
+					"host.name":    hostname,
+					"host.ip":      ip,
+				},
+			})
+			if err != nil {
+				return fail(fmt.Errorf("failed to create otlp exporter: %w", err))
+			}
+			spooled, err := spool("otlp", otlp)
+			if err != nil {
+				return fail(err, otlp)
+			}
+			pushSinks = append(pushSinks, spooled)
+		case "file":
+			file, err := machinestats.NewFileSink(machinestats.FileSinkConfig{
+				Path:     *filePath,
+				Format:   *fileFormat,
+				MaxSize:  int64(*fileMaxSize),
+				MaxAge:   *fileMaxAge,
+				Compress: *fileCompress,
+			})
+			if err != nil {
+				return fail(fmt.Errorf("failed to create file sink: %w", err))
+			}
+			pushSinks = append(pushSinks, file)
+		case "log":
+			pushSinks = append(pushSinks, machinestats.NewLogSink())
 		}
-	}()
-
-	mux, stop, err := machinestats.StartHTTPServer("0.0.0.0", *serverPort)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start HTTP server: %v\n", err)
-		os.Exit(-1)
-		return
 	}
-	defer stop()
-
-	var lastMeasurementTimeNanos int64
-	var lastMeasurements map[string]interface{}
-	mutex := sync.Mutex{}
-
-	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-		mutex.Lock()
-		defer mutex.Unlock()
-		now := time.Now().UnixNano()
-		var measurements map[string]interface{}
-		if time.Duration(time.Duration(now-lastMeasurementTimeNanos).Milliseconds()) <= 2*time.Duration(*interval)*time.Millisecond {
-			// We have recent stats
-			measurements = lastMeasurements
+	if *aggregateWindow > 0 && len(pushSinks) > 0 {
+		percentiles, err := parsePercentiles(*aggregatePercentile)
+		if err != nil {
+			return fail(fmt.Errorf("invalid --aggregate-percentiles: %w", err))
 		}
-		m := map[string]interface{}{
-			"timestamp": time.Duration(lastMeasurementTimeNanos).Milliseconds(),
-			"data":      measurements,
+		aggregator, err := machinestats.NewAggregatingSink(machinestats.NewMultiSink(pushSinks...), machinestats.AggregationConfig{
+			Window:      *aggregateWindow,
+			Percentiles: percentiles,
+		})
+		if err != nil {
+			return fail(fmt.Errorf("failed to create aggregating sink: %w", err))
 		}
-		b, _ := json.Marshal(m)
-		w.Write(b)
-	})
+		pushSinks = []machinestats.Sink{aggregator}
+	}
+	sinks = append(sinks, pushSinks...)
+	for _, sink := range shared {
+		sinks = append(sinks, sharedSink{sink})
+	}
+	return machinestats.NewMultiSink(sinks...), stats, exporter, nil
+}
 
-	for {
-		func() {
-			mutex.Lock()
-			defer mutex.Unlock()
-			lastMeasurements = make(map[string]interface{})
-			for _, stat := range stats {
-				// Make a copy of all measurements so we can track last measurements and write it all to channel
-				localChan := make(chan machinestats.Measurement)
-				wg := sync.WaitGroup{}
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					for m := range localChan {
-						lastMeasurements[m.Name()] = m.Value()
-						channel <- m
-					}
-				}()
-				err := stat.Measure(localChan)
-				if err != nil {
-					log.Errorf("Failed to parse stat '%v': %v\n", stat.Name(), err)
-					continue
-				}
-				close(localChan)
-				wg.Wait()
-			}
-			lastMeasurementTimeNanos = time.Now().UnixNano()
-		}()
-		time.Sleep(time.Duration(*interval) * time.Millisecond)
+// parsePercentiles parses a comma separated list of percentiles
+func parsePercentiles(value string) ([]float64, error) {
+	percentiles := make([]float64, 0)
+	for _, field := range splitList(value) {
+		p, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, err
+		}
+		percentiles = append(percentiles, p)
 	}
+	return percentiles, nil
 }
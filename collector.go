@@ -0,0 +1,707 @@
+package machinestats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultCollectorWorkers is the default number of stats measured at once
+const defaultCollectorWorkers = 4
+
+// SnapshotEntry is the latest value of a single measurement
+type SnapshotEntry struct {
+	Value interface{}
+	// Timestamp at which the stat that produced the value was measured, in
+	// nanoseconds since the epoch
+	Timestamp int64
+	// Interval at which the stat that produced the value is measured
+	Interval time.Duration
+	// Type, Unit and Description describe the measurement
+	Type        StatType
+	Unit        Unit
+	Description string
+}
+
+// Snapshot holds the latest value of every measurement
+type Snapshot struct {
+	// Timestamp is the time at which the most recent cycle finished, in
+	// nanoseconds since the epoch
+	Timestamp int64
+	// Entries maps each measurement name to its latest value
+	Entries map[string]SnapshotEntry
+}
+
+// Fresh returns the values that are no older than twice the interval of the
+// stat that produced them
+func (s Snapshot) Fresh(now int64) map[string]interface{} {
+	values := make(map[string]interface{}, len(s.Entries))
+	for name, entry := range s.Entries {
+		if time.Duration(now-entry.Timestamp) <= 2*entry.Interval {
+			values[name] = entry.Value
+		}
+	}
+	return values
+}
+
+// Collector owns a set of stats and measures each of them periodically,
+// writing every measurement to a sink. Every stat has its own interval and is
+// measured at multiples of that interval on the wall clock so that multiple
+// hosts report at the same instants. Stats that are due at the same instant
+// form a cycle, and cycles run independently of each other, so a slow stat
+// only delays the stats of its own cycle and never the next ticks of others.
+type Collector struct {
+	interval time.Duration
+	sink     Sink
+	mutex    sync.RWMutex
+	// cycle is held while a cycle's measurements are written to the sink
+	cycle    sync.Mutex
+	stats    []*scheduledStat
+	snapshot Snapshot
+	// slots has room for as many stats as may be measured at the same time
+	slots  chan struct{}
+	health CollectorHealth
+	wakeup chan struct{}
+	cancel context.CancelFunc
+	abort  context.CancelFunc
+	done   chan struct{}
+	// unregistered keeps the health of unregistered stats, which a stat that
+	// is registered again under the same name continues from
+	unregistered map[string]StatHealth
+}
+
+// StatOptions configures how a registered stat is scheduled
+type StatOptions struct {
+	// Interval at which the stat is measured. 0 uses the collector's default.
+	Interval time.Duration
+	// Timeout after which a measurement is abandoned. 0 uses half the
+	// interval, which leaves a hung stat's cycle time to be delivered before
+	// the stat is due again.
+	Timeout time.Duration
+}
+
+// scheduledStat tracks when a stat is due and which measurements it produced
+// last time
+type scheduledStat struct {
+	stat     ContextStat
+	interval time.Duration
+	timeout  time.Duration
+	next     time.Time
+	names    []string
+	health   StatHealth
+	removed  bool
+	// running is set while the stat is being measured, during which its
+	// ticks are skipped
+	running bool
+	// recorded is the start of the measurement that is in the snapshot
+	recorded time.Time
+}
+
+// StatHealth describes how measuring a stat went
+type StatHealth struct {
+	// Interval at which the stat is measured
+	Interval time.Duration
+	// Duration of the most recent measurement
+	Duration time.Duration
+	// Measurements produced by the most recent measurement
+	Measurements int
+	// Errors is the number of failed measurements since the collector was
+	// created
+	Errors uint64
+	// Timeouts is the number of measurements that were abandoned since the
+	// collector was created
+	Timeouts uint64
+	// ConsecutiveErrors is the number of measurements that failed since the
+	// last successful one
+	ConsecutiveErrors int
+	// LastError is the error of the most recent measurement, if it failed
+	LastError string
+	// LastSuccess is the time at which the most recent successful measurement
+	// started. It is zero if the stat has never been measured successfully.
+	LastSuccess time.Time
+}
+
+// CollectorHealth describes how the collector itself is doing
+type CollectorHealth struct {
+	// Stats maps each stat's name to its health
+	Stats map[string]StatHealth
+	// SinkErrors is the number of failed sink writes and flushes since the
+	// collector was created. A failure of several sinks behind a MultiSink
+	// counts once per sink.
+	SinkErrors uint64
+	// Backlog is the number of stats that had to wait for a free worker
+	// during the most recent cycle
+	Backlog int
+	// LastCycle is the time at which the most recent cycle finished. It is
+	// zero if no cycle has finished yet.
+	LastCycle time.Time
+	// LastSinkError is the error of the most recent cycle's sink writes and
+	// flush, if any of them failed
+	LastSinkError string
+}
+
+// NewCollector creates a Collector that writes to sink. interval is used for
+// every stat that is registered without an interval of its own.
+func NewCollector(interval time.Duration, sink Sink) *Collector {
+	return &Collector{
+		interval: interval,
+		sink:     sink,
+		stats:    make([]*scheduledStat, 0),
+		snapshot: Snapshot{Entries: make(map[string]SnapshotEntry)},
+		slots:    make(chan struct{}, defaultCollectorWorkers),
+		health:   CollectorHealth{Stats: make(map[string]StatHealth)},
+		wakeup:   make(chan struct{}, 1),
+	}
+}
+
+// Register adds stats that are measured at the collector's default interval.
+// It is safe to call while the collector is running.
+func (c *Collector) Register(stats ...Stat) {
+	c.RegisterWithInterval(c.interval, stats...)
+}
+
+// RegisterWithInterval adds stats that are measured at the given interval. An
+// interval of 0 uses the collector's default. Newly registered stats are
+// measured right away if the collector is running.
+func (c *Collector) RegisterWithInterval(interval time.Duration, stats ...Stat) {
+	c.RegisterWithOptions(StatOptions{Interval: interval}, stats...)
+}
+
+// RegisterWithOptions adds stats that are scheduled according to options
+func (c *Collector) RegisterWithOptions(options StatOptions, stats ...Stat) {
+	if options.Interval <= 0 {
+		options.Interval = c.interval
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = options.Interval / 2
+	}
+	c.mutex.Lock()
+	for _, stat := range stats {
+		health, ok := c.unregistered[stat.Name()]
+		if ok {
+			delete(c.unregistered, stat.Name())
+		}
+		health.Interval = options.Interval
+		c.stats = append(c.stats, &scheduledStat{
+			stat:     WithContext(stat),
+			interval: options.Interval,
+			timeout:  options.Timeout,
+			health:   health,
+		})
+	}
+	c.mutex.Unlock()
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Unregister removes the stats with the given names, along with their values
+// in the snapshot. It waits for the cycle that is being written to finish, and
+// measurements of the stats that are still in progress are discarded. Their
+// health is kept for stats that are registered under the same names later on.
+func (c *Collector) Unregister(names ...string) {
+	remove := make(map[string]bool, len(names))
+	for _, name := range names {
+		remove[name] = true
+	}
+	c.cycle.Lock()
+	defer c.cycle.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.unregistered == nil {
+		c.unregistered = make(map[string]StatHealth)
+	}
+	kept := make([]*scheduledStat, 0, len(c.stats))
+	for _, s := range c.stats {
+		if !remove[s.stat.Name()] {
+			kept = append(kept, s)
+			continue
+		}
+		s.removed = true
+		c.unregistered[s.stat.Name()] = s.health
+		for _, name := range s.names {
+			delete(c.snapshot.Entries, name)
+		}
+	}
+	c.stats = kept
+}
+
+// ReplaceSink closes the collector's sink once the cycle that is being written
+// has finished and replaces it with the one that create returns. Nothing is
+// collected in between, so the new sink can take over files that the previous
+// one held. If create fails nothing is written until ReplaceSink succeeds.
+func (c *Collector) ReplaceSink(create func() (Sink, error)) error {
+	c.cycle.Lock()
+	defer c.cycle.Unlock()
+	closeErr := c.sink.Close()
+	sink, err := create()
+	if err != nil {
+		sink = NewMultiSink()
+	}
+	c.mutex.Lock()
+	c.sink = sink
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close previous sink: %w", closeErr)
+	}
+	return nil
+}
+
+// SetWorkers limits how many stats are measured at the same time. n < 1 is
+// treated as 1.
+func (c *Collector) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Measurements in progress return their slots to the previous channel
+	c.slots = make(chan struct{}, n)
+}
+
+// Workers is the maximum number of stats that are measured at the same time
+func (c *Collector) Workers() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return cap(c.slots)
+}
+
+// Interval is the collector's default interval
+func (c *Collector) Interval() time.Duration {
+	return c.interval
+}
+
+// Snapshot returns a copy of the latest value of every measurement
+func (c *Collector) Snapshot() Snapshot {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	entries := make(map[string]SnapshotEntry, len(c.snapshot.Entries))
+	for k, v := range c.snapshot.Entries {
+		entries[k] = v
+	}
+	return Snapshot{
+		Timestamp: c.snapshot.Timestamp,
+		Entries:   entries,
+	}
+}
+
+// Health returns how the collector and each of its stats are doing
+func (c *Collector) Health() CollectorHealth {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	stats := make(map[string]StatHealth, len(c.stats))
+	for _, s := range c.stats {
+		stats[s.stat.Name()] = s.health
+	}
+	return CollectorHealth{
+		Stats:         stats,
+		SinkErrors:    c.health.SinkErrors,
+		Backlog:       c.health.Backlog,
+		LastCycle:     c.health.LastCycle,
+		LastSinkError: c.health.LastSinkError,
+	}
+}
+
+// Start runs the collector in the background until ctx is cancelled or Stop
+// or Shutdown is called
+func (c *Collector) Start(ctx context.Context) {
+	measureCtx, abort := context.WithCancel(ctx)
+	scheduleCtx, cancel := context.WithCancel(measureCtx)
+	done := make(chan struct{})
+	c.mutex.Lock()
+	c.cancel = cancel
+	c.abort = abort
+	c.done = done
+	c.mutex.Unlock()
+	go func() {
+		defer close(done)
+		c.run(scheduleCtx, measureCtx)
+	}()
+}
+
+// Stop a collector that was started with Start, abandoning any measurements
+// in progress, and wait for it to finish
+func (c *Collector) Stop() {
+	c.mutex.Lock()
+	abort := c.abort
+	done := c.done
+	c.mutex.Unlock()
+	if abort == nil {
+		return
+	}
+	abort()
+	<-done
+}
+
+// Shutdown stops a collector that was started with Start from starting new
+// cycles and waits for the cycles in progress to be written to the sink. If ctx
+// is done first, the measurements in progress are abandoned, whatever they
+// produced so far is still written, and ctx's error is returned.
+func (c *Collector) Shutdown(ctx context.Context) error {
+	c.mutex.Lock()
+	cancel := c.cancel
+	abort := c.abort
+	done := c.done
+	c.mutex.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		abort()
+		return nil
+	case <-ctx.Done():
+		abort()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Run measures every stat immediately and then each stat at its own interval
+// boundaries until ctx is cancelled
+func (c *Collector) Run(ctx context.Context) {
+	c.run(ctx, ctx)
+}
+
+// run starts a cycle for the stats that are due until scheduleCtx is cancelled
+// and then waits for the cycles in progress. Measurements are abandoned when
+// measureCtx is cancelled.
+func (c *Collector) run(scheduleCtx context.Context, measureCtx context.Context) {
+	cycles := sync.WaitGroup{}
+	defer cycles.Wait()
+	start := func(stats []*scheduledStat) {
+		if len(stats) == 0 {
+			return
+		}
+		cycles.Add(1)
+		go func() {
+			defer cycles.Done()
+			c.collect(measureCtx, stats)
+		}()
+	}
+	start(c.claim(c.all()))
+	for {
+		timer := time.NewTimer(time.Until(c.nextDue()))
+		select {
+		case <-scheduleCtx.Done():
+			timer.Stop()
+			return
+		case <-c.wakeup:
+			timer.Stop()
+		case <-timer.C:
+		}
+		if scheduleCtx.Err() != nil {
+			// Stopped at the same time as the timer fired
+			return
+		}
+		start(c.claim(c.due(time.Now())))
+	}
+}
+
+// Collect measures every registered stat once regardless of its schedule,
+// apart from stats that are being measured already
+func (c *Collector) Collect() {
+	c.collect(context.Background(), c.claim(c.all()))
+}
+
+// all returns every registered stat
+func (c *Collector) all() []*scheduledStat {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	stats := make([]*scheduledStat, len(c.stats))
+	copy(stats, c.stats)
+	return stats
+}
+
+// nextDue returns the earliest time at which a stat that is not running is
+// due. Stats that finish wake the scheduler up to reconsider.
+func (c *Collector) nextDue() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var next time.Time
+	found := false
+	for _, s := range c.stats {
+		if s.running {
+			continue
+		}
+		if !found || s.next.Before(next) {
+			next = s.next
+			found = true
+		}
+	}
+	if !found {
+		return nextTick(time.Now(), c.interval)
+	}
+	return next
+}
+
+// due returns the stats that should be measured at now
+func (c *Collector) due(now time.Time) []*scheduledStat {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	due := make([]*scheduledStat, 0)
+	for _, s := range c.stats {
+		if !s.next.After(now) {
+			due = append(due, s)
+		}
+	}
+	return due
+}
+
+// claim marks the stats as running and returns those that were not running
+// already. A stat whose previous measurement is still in progress skips the
+// tick.
+func (c *Collector) claim(stats []*scheduledStat) []*scheduledStat {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	claimed := make([]*scheduledStat, 0, len(stats))
+	for _, s := range stats {
+		if s.running || s.removed {
+			continue
+		}
+		s.running = true
+		claimed = append(claimed, s)
+	}
+	return claimed
+}
+
+// wake makes the scheduler reconsider which stat is due next
+func (c *Collector) wake() {
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// collect measures the given stats concurrently, writes their measurements to
+// the sink and updates the snapshot. The stats must have been claimed. Each
+// stat's measurements are written as one batch, in the order in which the
+// stats were registered, and the sink is flushed once per cycle. Measurements
+// that a stat produced before failing or timing out are always delivered,
+// followed by a count of the failure.
+func (c *Collector) collect(ctx context.Context, stats []*scheduledStat) {
+	if len(stats) == 0 {
+		return
+	}
+	results := make([]statResult, len(stats))
+	c.mutex.RLock()
+	slots := c.slots
+	c.mutex.RUnlock()
+	backlog := 0
+	wg := sync.WaitGroup{}
+
+	for idx, s := range stats {
+		select {
+		case slots <- struct{}{}:
+		default:
+			backlog++
+			slots <- struct{}{}
+		}
+		wg.Add(1)
+		go func(idx int, s *scheduledStat) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			start := time.Now()
+			batch, err := measure(ctx, s.stat, s.timeout)
+			results[idx] = statResult{batch, err, start}
+
+			c.mutex.Lock()
+			s.running = false
+			s.next = nextTick(time.Now(), s.interval)
+			s.health.Duration = time.Since(start)
+			s.health.Measurements = len(batch)
+			if err != nil {
+				s.health.Errors++
+				s.health.ConsecutiveErrors++
+				s.health.LastError = err.Error()
+			} else {
+				s.health.ConsecutiveErrors = 0
+				s.health.LastError = ""
+				s.health.LastSuccess = start
+			}
+			if err == context.DeadlineExceeded || err == errStillMeasuring {
+				s.health.Timeouts++
+			}
+			c.mutex.Unlock()
+			c.wake()
+		}(idx, s)
+	}
+	wg.Wait()
+
+	c.cycle.Lock()
+	defer c.cycle.Unlock()
+	sinkErrs := make([]error, 0)
+	for idx, s := range stats {
+		if !c.isRegistered(s) {
+			// Unregistered while it was being measured
+			continue
+		}
+		result := results[idx]
+		// Whatever the stat measured before failing is still delivered
+		batch := result.batch
+		if result.err != nil {
+			switch result.err {
+			case context.DeadlineExceeded:
+				log.Errorf("Timed out measuring stat '%v' after %v\n", s.stat.Name(), s.timeout)
+				batch = append(batch, timeoutMeasurement(s.stat))
+			case errStillMeasuring:
+				// Counted as a timeout since the stat is still stuck
+				log.Errorf("Skipped stat '%v': %v\n", s.stat.Name(), result.err)
+				batch = append(batch, timeoutMeasurement(s.stat))
+			default:
+				log.Errorf("Failed to parse stat '%v': %v\n", s.stat.Name(), result.err)
+			}
+			batch = append(batch, errorMeasurement(s.stat))
+		}
+		c.record(s, result.batch, result.start)
+		if err := c.sink.Write(batch); err != nil {
+			log.Errorf("Failed to write stat '%v': %v\n", s.stat.Name(), err)
+			c.countSinkErrors(err)
+			sinkErrs = append(sinkErrs, err)
+		}
+	}
+	if err := c.sink.Flush(); err != nil {
+		log.Errorf("Failed to flush sinks: %v\n", err)
+		c.countSinkErrors(err)
+		sinkErrs = append(sinkErrs, err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	c.snapshot.Timestamp = now.UnixNano()
+	c.health.Backlog = backlog
+	c.health.LastCycle = now
+	c.health.LastSinkError = ""
+	if len(sinkErrs) > 0 {
+		// The flush is the last thing that happened to the sink
+		c.health.LastSinkError = sinkErrs[len(sinkErrs)-1].Error()
+	}
+}
+
+// isRegistered returns whether the stat has not been unregistered
+func (c *Collector) isRegistered(s *scheduledStat) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return !s.removed
+}
+
+// countSinkErrors counts a failed sink operation, once for each sink that
+// failed
+func (c *Collector) countSinkErrors(err error) {
+	count := uint64(1)
+	if errs, ok := err.(multiError); ok {
+		count = uint64(len(errs))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.health.SinkErrors += count
+}
+
+// statResult is the outcome of measuring a single stat
+type statResult struct {
+	batch []Measurement
+	err   error
+	start time.Time
+}
+
+// record replaces the stat's previous measurements in the snapshot, unless a
+// cycle that started later has recorded the stat already. Values are stamped
+// with the time at which they were measured, or start if the measurement does
+// not carry a timestamp.
+func (c *Collector) record(s *scheduledStat, batch []Measurement, start time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if start.Before(s.recorded) {
+		return
+	}
+	s.recorded = start
+	fallback := start.UnixNano()
+	for _, name := range s.names {
+		delete(c.snapshot.Entries, name)
+	}
+	s.names = make([]string, len(batch))
+	for idx, m := range batch {
+		s.names[idx] = m.Name()
+		unit, description := measurementMetadata(m)
+		c.snapshot.Entries[m.Name()] = SnapshotEntry{
+			Value:       m.Value(),
+			Timestamp:   measurementTime(m, fallback),
+			Interval:    s.interval,
+			Type:        m.Type(),
+			Unit:        unit,
+			Description: description,
+		}
+	}
+}
+
+// errorMeasurement counts a measurement of stat that failed
+func errorMeasurement(stat Stat) Measurement {
+	return &BasicMeasurement{
+		name:            fmt.Sprintf("machinestatsd.errors.%v", stat.Name()),
+		measurementType: Counter,
+		value:           1,
+		timestamp:       nowFn(),
+		description:     "Failed measurements of the stat",
+	}
+}
+
+// timeoutMeasurement counts a measurement of stat that timed out
+func timeoutMeasurement(stat Stat) Measurement {
+	return &BasicMeasurement{
+		name:            fmt.Sprintf("machinestatsd.timeouts.%v", stat.Name()),
+		measurementType: Counter,
+		value:           1,
+		timestamp:       nowFn(),
+		description:     "Measurements of the stat that timed out",
+	}
+}
+
+// measure runs a single stat with a deadline and returns everything it
+// measured, even if it failed. The channel given to the stat is always closed
+// and drained before returning, and a panicking stat is reported as an error.
+func measure(ctx context.Context, stat ContextStat, timeout time.Duration) ([]Measurement, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	channel := make(chan Measurement)
+	batch := make([]Measurement, 0)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for m := range channel {
+			batch = append(batch, m)
+		}
+	}()
+	err := measureSafely(ctx, stat, channel)
+	close(channel)
+	wg.Wait()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		// Report the timeout regardless of how the stat wrapped it
+		err = context.DeadlineExceeded
+	}
+	return batch, err
+}
+
+// measureSafely calls MeasureContext, converting a panic into an error
+func measureSafely(ctx context.Context, stat ContextStat, channel chan<- Measurement) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("stat '%v' panicked: %v", stat.Name(), r)
+		}
+	}()
+	return stat.MeasureContext(ctx, channel)
+}
+
+// nextTick returns the first multiple of interval after now
+func nextTick(now time.Time, interval time.Duration) time.Time {
+	return now.Truncate(interval).Add(interval)
+}
@@ -0,0 +1,636 @@
+package machinestats
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStat emits a fixed set of gauges and counts how often it was measured
+type fakeStat struct {
+	name   string
+	values map[string]interface{}
+	err    error
+	mutex  sync.Mutex
+	calls  int
+}
+
+func (f *fakeStat) Name() string {
+	return f.name
+}
+
+func (f *fakeStat) Measure(channel chan<- Measurement) error {
+	f.mutex.Lock()
+	f.calls++
+	f.mutex.Unlock()
+	for k, v := range f.values {
+		channel <- &BasicMeasurement{name: k, measurementType: Gauge, value: v}
+	}
+	return f.err
+}
+
+func (f *fakeStat) numCalls() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls
+}
+
+// funcStat measures by calling a function
+type funcStat struct {
+	name    string
+	measure func(chan<- Measurement) error
+}
+
+func (f *funcStat) Name() string {
+	return f.name
+}
+
+func (f *funcStat) Measure(channel chan<- Measurement) error {
+	return f.measure(channel)
+}
+
+// syncSink is a thread-safe sink that records everything it is given
+type syncSink struct {
+	mutex   sync.Mutex
+	written []Measurement
+	flushes int
+}
+
+func (s *syncSink) Write(measurements []Measurement) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.written = append(s.written, measurements...)
+	return nil
+}
+
+func (s *syncSink) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.flushes++
+	return nil
+}
+
+func (s *syncSink) Close() error {
+	return nil
+}
+
+func (s *syncSink) numFlushes() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.flushes
+}
+
+func TestCollectorCollect(t *testing.T) {
+	require := require.New(t)
+
+	sink := &syncSink{}
+	collector := NewCollector(time.Second, sink)
+	collector.Register(
+		&fakeStat{name: "a", values: map[string]interface{}{"a.value": 1.0}},
+		&fakeStat{name: "b", values: map[string]interface{}{"b.value": 2}},
+		&fakeStat{name: "broken", err: fmt.Errorf("boom")},
+	)
+
+	require.Empty(collector.Snapshot().Entries)
+	collector.Collect()
+
+	snapshot := collector.Snapshot()
+	require.NotZero(snapshot.Timestamp)
+	require.Equal(map[string]interface{}{"a.value": 1.0, "b.value": 2}, snapshot.Fresh(snapshot.Timestamp))
+	require.Equal(3, len(sink.written))
+	require.Equal("machinestatsd.errors.broken", sink.written[2].Name())
+	require.Equal(Counter, sink.written[2].Type())
+	require.Equal(1, sink.flushes)
+}
+
+func TestCollectorStartStop(t *testing.T) {
+	require := require.New(t)
+
+	sink := &syncSink{}
+	stat := &fakeStat{name: "a", values: map[string]interface{}{"a.value": 1.0}}
+	collector := NewCollector(20*time.Millisecond, sink)
+	collector.Register(stat)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collector.Start(ctx)
+	time.Sleep(110 * time.Millisecond)
+	collector.Stop()
+
+	calls := stat.numCalls()
+	require.True(calls >= 3, "expected at least 3 collections, got %v", calls)
+	require.Equal(calls, sink.numFlushes())
+
+	// No more collections happen once stopped
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(calls, stat.numCalls())
+}
+
+func TestCollectorShutdown(t *testing.T) {
+	require := require.New(t)
+
+	names := func(sink *syncSink) []string {
+		sink.mutex.Lock()
+		defer sink.mutex.Unlock()
+		result := make([]string, len(sink.written))
+		for idx, m := range sink.written {
+			result[idx] = m.Name()
+		}
+		return result
+	}
+
+	// The cycle in progress is allowed to finish
+	sink := &syncSink{}
+	collector := NewCollector(time.Hour, sink)
+	collector.Register(&sleepStat{name: "slow", delay: 50 * time.Millisecond, count: 1})
+	collector.Start(context.Background())
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(collector.Shutdown(ctx))
+	require.Equal([]string{"slow.0"}, names(sink))
+	require.Equal(1, sink.numFlushes())
+
+	// Unless it takes longer than the deadline
+	blocking := &blockingStat{release: make(chan struct{})}
+	defer close(blocking.release)
+	sink = &syncSink{}
+	collector = NewCollector(time.Hour, sink)
+	collector.Register(blocking)
+	collector.Start(context.Background())
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Equal(context.DeadlineExceeded, collector.Shutdown(ctx))
+	require.Equal([]string{"machinestatsd.errors.blocking"}, names(sink))
+	require.Equal(1, sink.numFlushes())
+
+	// Collectors that were never started have nothing to shut down
+	require.Nil(NewCollector(time.Hour, sink).Shutdown(ctx))
+}
+
+func TestCollectorPerStatInterval(t *testing.T) {
+	require := require.New(t)
+
+	sink := &syncSink{}
+	fast := &fakeStat{name: "fast", values: map[string]interface{}{"fast.value": 1}}
+	slow := &fakeStat{name: "slow", values: map[string]interface{}{"slow.value": 2}}
+	collector := NewCollector(20*time.Millisecond, sink)
+	collector.Register(fast)
+	collector.RegisterWithInterval(time.Hour, slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collector.Start(ctx)
+	time.Sleep(110 * time.Millisecond)
+	collector.Stop()
+
+	require.True(fast.numCalls() >= 3, "expected at least 3 collections, got %v", fast.numCalls())
+	require.Equal(1, slow.numCalls())
+
+	snapshot := collector.Snapshot()
+	require.Equal(time.Hour, snapshot.Entries["slow.value"].Interval)
+	require.Equal(20*time.Millisecond, snapshot.Entries["fast.value"].Interval)
+}
+
+func TestCollectorHungStatKeepsOthersOnSchedule(t *testing.T) {
+	require := require.New(t)
+
+	blocking := &blockingStat{release: make(chan struct{})}
+	defer close(blocking.release)
+	fast := &fakeStat{name: "fast", values: map[string]interface{}{"fast.value": 1}}
+	sink := &syncSink{}
+	collector := NewCollector(20*time.Millisecond, sink)
+	collector.Register(fast)
+	collector.RegisterWithOptions(StatOptions{Interval: 200 * time.Millisecond, Timeout: time.Hour}, blocking)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collector.Start(ctx)
+	time.Sleep(300 * time.Millisecond)
+	calls := fast.numCalls()
+	flushes := sink.numFlushes()
+	collector.Stop()
+
+	// The fast stat keeps its cadence and is delivered while the other one
+	// hangs, which only skips its own ticks
+	require.True(calls >= 10, "expected at least 10 collections, got %v", calls)
+	require.True(flushes >= 9, "expected at least 9 flushes, got %v", flushes)
+	require.Equal(uint64(0), collector.Health().Stats["blocking"].Timeouts)
+}
+
+func TestCollectorRegisterWhileRunning(t *testing.T) {
+	require := require.New(t)
+
+	collector := NewCollector(time.Hour, &syncSink{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collector.Start(ctx)
+	defer collector.Stop()
+
+	stat := &fakeStat{name: "late", values: map[string]interface{}{"late.value": 1}}
+	collector.Register(stat)
+	require.Eventually(func() bool {
+		return stat.numCalls() == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestCollectorMeasurementTimestamps(t *testing.T) {
+	require := require.New(t)
+
+	timestamp := time.Now().Add(-time.Second).UnixNano()
+	stat := &fakeStat{name: "a", values: map[string]interface{}{"a.value": 1}}
+	collector := NewCollector(time.Minute, &syncSink{})
+	collector.Register(stat, &funcStat{"stamped", func(channel chan<- Measurement) error {
+		channel <- &BasicMeasurement{name: "stamped.value", measurementType: Gauge, value: 2, timestamp: timestamp}
+		return nil
+	}})
+	collector.Collect()
+
+	snapshot := collector.Snapshot()
+	require.Equal(timestamp, snapshot.Entries["stamped.value"].Timestamp)
+	// Measurements without a timestamp use the time the stat was measured
+	require.True(snapshot.Entries["a.value"].Timestamp > timestamp)
+}
+
+func TestSnapshotFresh(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now().UnixNano()
+	snapshot := Snapshot{
+		Timestamp: now,
+		Entries: map[string]SnapshotEntry{
+			"fast": {Value: 1, Timestamp: now - int64(3*time.Second), Interval: time.Second},
+			"slow": {Value: 2, Timestamp: now - int64(3*time.Second), Interval: time.Minute},
+		},
+	}
+	require.Equal(map[string]interface{}{"slow": 2}, snapshot.Fresh(now))
+}
+
+// blockingStat never finishes measuring until it is released
+type blockingStat struct {
+	release chan struct{}
+}
+
+func (b *blockingStat) Name() string {
+	return "blocking"
+}
+
+func (b *blockingStat) Measure(channel chan<- Measurement) error {
+	<-b.release
+	channel <- &BasicMeasurement{name: "blocking.value", measurementType: Gauge, value: 1}
+	return nil
+}
+
+func TestCollectorTimeout(t *testing.T) {
+	require := require.New(t)
+
+	blocking := &blockingStat{release: make(chan struct{})}
+	defer close(blocking.release)
+
+	sink := &syncSink{}
+	collector := NewCollector(time.Second, sink)
+	collector.RegisterWithOptions(StatOptions{Timeout: 20 * time.Millisecond}, blocking)
+	collector.Register(&fakeStat{name: "a", values: map[string]interface{}{"a.value": 1.0}})
+
+	start := time.Now()
+	collector.Collect()
+	require.True(time.Since(start) < 500*time.Millisecond)
+
+	require.Equal(3, len(sink.written))
+	require.Equal("machinestatsd.timeouts.blocking", sink.written[0].Name())
+	require.Equal(Counter, sink.written[0].Type())
+	require.Equal(1, sink.written[0].Value())
+	require.Equal("machinestatsd.errors.blocking", sink.written[1].Name())
+	require.Equal("a.value", sink.written[2].Name())
+	require.NotContains(collector.Snapshot().Entries, "blocking.value")
+}
+
+func TestCollectorDefaultTimeout(t *testing.T) {
+	require := require.New(t)
+
+	blocking := &blockingStat{release: make(chan struct{})}
+	defer close(blocking.release)
+	fast := &fakeStat{name: "fast", values: map[string]interface{}{"fast.value": 1}}
+	sink := &syncSink{}
+	collector := NewCollector(20*time.Millisecond, sink)
+	collector.Register(fast)
+	collector.RegisterWithInterval(200*time.Millisecond, blocking)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collector.Start(ctx)
+	defer collector.Stop()
+
+	// The hung stat is abandoned after half its interval, in time for the
+	// first cycle, which the fast stat was part of, to be delivered
+	require.Eventually(func() bool {
+		return collector.Health().Stats["blocking"].Timeouts == 1
+	}, 150*time.Millisecond, 5*time.Millisecond)
+	require.True(fast.numCalls() >= 3, "expected at least 3 collections, got %v", fast.numCalls())
+	for _, s := range collector.all() {
+		if s.stat.Name() == "blocking" {
+			require.Equal(100*time.Millisecond, s.timeout)
+		}
+	}
+}
+
+// countingStat blocks until released and counts the calls that are running
+type countingStat struct {
+	release chan struct{}
+	running int32
+	most    int32
+}
+
+func (c *countingStat) Name() string {
+	return "counting"
+}
+
+func (c *countingStat) Measure(channel chan<- Measurement) error {
+	running := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	if running > atomic.LoadInt32(&c.most) {
+		atomic.StoreInt32(&c.most, running)
+	}
+	<-c.release
+	return nil
+}
+
+func TestCollectorSkipsAbandonedStats(t *testing.T) {
+	require := require.New(t)
+
+	stat := &countingStat{release: make(chan struct{})}
+	sink := &syncSink{}
+	collector := NewCollector(time.Second, sink)
+	collector.RegisterWithOptions(StatOptions{Timeout: 10 * time.Millisecond}, stat)
+	before := runtime.NumGoroutine()
+	for idx := 0; idx < 5; idx++ {
+		collector.Collect()
+	}
+	// Only the first call runs, the others are skipped and count as timeouts
+	require.Equal(int32(1), atomic.LoadInt32(&stat.most))
+	require.True(runtime.NumGoroutine() <= before+2)
+	require.Equal(uint64(5), collector.Health().Stats["counting"].Timeouts)
+	timeouts := 0
+	for _, m := range sink.written {
+		if m.Name() == "machinestatsd.timeouts.counting" {
+			timeouts++
+		}
+	}
+	require.Equal(5, timeouts)
+
+	// Once the abandoned call returns the stat is measured again
+	close(stat.release)
+	require.Eventually(func() bool {
+		collector.Collect()
+		return collector.Health().Stats["counting"].ConsecutiveErrors == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// sleepStat measures a sequence of values after a delay
+type sleepStat struct {
+	name  string
+	delay time.Duration
+	count int
+}
+
+func (s *sleepStat) Name() string {
+	return s.name
+}
+
+func (s *sleepStat) Measure(channel chan<- Measurement) error {
+	time.Sleep(s.delay)
+	for idx := 0; idx < s.count; idx++ {
+		channel <- &BasicMeasurement{name: fmt.Sprintf("%v.%v", s.name, idx), measurementType: Gauge, value: idx}
+	}
+	return nil
+}
+
+func TestCollectorParallel(t *testing.T) {
+	require := require.New(t)
+
+	collect := func(workers int) (time.Duration, []string) {
+		sink := &syncSink{}
+		collector := NewCollector(time.Second, sink)
+		collector.SetWorkers(workers)
+		// The slowest stat is registered first and must still be written first
+		collector.Register(
+			&sleepStat{name: "a", delay: 60 * time.Millisecond, count: 3},
+			&sleepStat{name: "b", delay: 40 * time.Millisecond, count: 3},
+			&sleepStat{name: "c", delay: 20 * time.Millisecond, count: 3},
+		)
+		start := time.Now()
+		collector.Collect()
+		elapsed := time.Since(start)
+
+		names := make([]string, 0)
+		for _, m := range sink.written {
+			names = append(names, m.Name())
+		}
+		require.Equal(9, len(collector.Snapshot().Entries))
+		return elapsed, names
+	}
+
+	expected := []string{"a.0", "a.1", "a.2", "b.0", "b.1", "b.2", "c.0", "c.1", "c.2"}
+
+	elapsed, names := collect(3)
+	require.True(elapsed < 110*time.Millisecond, "parallel collection took %v", elapsed)
+	require.Equal(expected, names)
+
+	elapsed, names = collect(1)
+	require.True(elapsed >= 120*time.Millisecond, "serial collection took %v", elapsed)
+	require.Equal(expected, names)
+}
+
+// panicStat panics while measuring
+type panicStat struct{}
+
+func (p *panicStat) Name() string {
+	return "panic"
+}
+
+func (p *panicStat) Measure(channel chan<- Measurement) error {
+	channel <- &BasicMeasurement{name: "panic.value", measurementType: Gauge, value: 1}
+	panic("boom")
+}
+
+func TestCollectorPartialResults(t *testing.T) {
+	require := require.New(t)
+
+	sink := &syncSink{}
+	collector := NewCollector(time.Second, sink)
+	collector.Register(
+		&fakeStat{name: "broken", values: map[string]interface{}{"broken.value": 1}, err: fmt.Errorf("boom")},
+		&panicStat{},
+	)
+	collector.Collect()
+
+	names := make([]string, 0)
+	for _, m := range sink.written {
+		names = append(names, m.Name())
+	}
+	require.Equal([]string{
+		"broken.value",
+		"machinestatsd.errors.broken",
+		"panic.value",
+		"machinestatsd.errors.panic",
+	}, names)
+	require.Equal(map[string]interface{}{"broken.value": 1, "panic.value": 1}, collector.Snapshot().Fresh(time.Now().UnixNano()))
+}
+
+func TestCollectorFailingCyclesDoNotLeak(t *testing.T) {
+	require := require.New(t)
+
+	sink := &syncSink{}
+	collector := NewCollector(time.Second, sink)
+	collector.Register(
+		&fakeStat{name: "broken", values: map[string]interface{}{"a": 1, "b": 2}, err: fmt.Errorf("boom")},
+		&panicStat{},
+		&fakeStat{name: "ok", values: map[string]interface{}{"ok.value": 1}},
+	)
+	// Warm up so that lazily started runtime goroutines are not counted
+	collector.Collect()
+	before := runtime.NumGoroutine()
+
+	cycles := 500
+	for idx := 0; idx < cycles; idx++ {
+		collector.Collect()
+	}
+
+	// A leak would leave at least one goroutine behind per cycle. Allow some
+	// slack for goroutines that are still exiting.
+	after := before
+	for idx := 0; idx < 100; idx++ {
+		if after = runtime.NumGoroutine(); after <= before+5 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(after <= before+5, "goroutines grew from %v to %v", before, after)
+
+	errors := 0
+	for _, m := range sink.written {
+		if strings.HasPrefix(m.Name(), "machinestatsd.errors.") {
+			errors++
+		}
+	}
+	require.Equal(2*(cycles+1), errors)
+	require.Equal(cycles+1, sink.numFlushes())
+}
+
+func TestWithContext(t *testing.T) {
+	require := require.New(t)
+
+	// Stats that finish are passed through untouched
+	stat := WithContext(&fakeStat{name: "a", values: map[string]interface{}{"a.value": 1.0}, err: fmt.Errorf("boom")})
+	batch, err := measure(context.Background(), stat, time.Second)
+	require.EqualError(err, "boom")
+	require.Equal(1, len(batch))
+
+	// ContextStats are not wrapped again
+	require.Equal(stat, WithContext(stat))
+
+	// Stats that do not finish are abandoned
+	blocking := &blockingStat{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	channel := make(chan Measurement)
+	require.Equal(context.Canceled, WithContext(blocking).MeasureContext(ctx, channel))
+	// The abandoned measurement is discarded once it finishes
+	close(blocking.release)
+	select {
+	case <-channel:
+		require.Fail("abandoned measurement was delivered")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestCollectorContextCancel(t *testing.T) {
+	require := require.New(t)
+
+	collector := NewCollector(10*time.Millisecond, &syncSink{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		collector.Run(ctx)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail("Run did not return after the context was cancelled")
+	}
+}
+
+func TestCollectorUnregister(t *testing.T) {
+	require := require.New(t)
+
+	a := &fakeStat{name: "a", values: map[string]interface{}{"a.value": 1}}
+	b := &fakeStat{name: "b", values: map[string]interface{}{"b.value": 2}}
+	collector := NewCollector(time.Second, &syncSink{})
+	collector.Register(a, b)
+	collector.Collect()
+	require.Contains(collector.Snapshot().Entries, "a.value")
+
+	collector.Unregister("a", "missing")
+	require.NotContains(collector.Snapshot().Entries, "a.value")
+	require.Contains(collector.Snapshot().Entries, "b.value")
+	require.NotContains(collector.Health().Stats, "a")
+
+	collector.Collect()
+	require.Equal(1, a.numCalls())
+	require.Equal(2, b.numCalls())
+
+	// A stat that is registered again under the same name keeps its health
+	lastSuccess := collector.Health().Stats["b"].LastSuccess
+	collector.Unregister("b")
+	collector.RegisterWithInterval(2*time.Second, &fakeStat{name: "b", err: fmt.Errorf("boom")})
+	health := collector.Health().Stats["b"]
+	require.Equal(lastSuccess, health.LastSuccess)
+	require.Equal(2*time.Second, health.Interval)
+	collector.Collect()
+	health = collector.Health().Stats["b"]
+	require.Equal(lastSuccess, health.LastSuccess)
+	require.Equal(1, health.ConsecutiveErrors)
+}
+
+func TestCollectorReplaceSink(t *testing.T) {
+	require := require.New(t)
+
+	previous := &mockSink{}
+	collector := NewCollector(time.Second, previous)
+	collector.Register(&fakeStat{name: "a", values: map[string]interface{}{"a.value": 1}})
+
+	next := &mockSink{}
+	require.Nil(collector.ReplaceSink(func() (Sink, error) {
+		require.True(previous.closed)
+		return next, nil
+	}))
+	collector.Collect()
+	require.Empty(previous.written)
+	require.Len(next.written, 1)
+
+	// Without a sink nothing is written until one is created
+	require.Error(collector.ReplaceSink(func() (Sink, error) {
+		return nil, fmt.Errorf("expected")
+	}))
+	require.True(next.closed)
+	collector.Collect()
+	require.Len(next.written, 1)
+}
+
+func TestNextTick(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Date(2020, 1, 1, 10, 0, 7, 500, time.UTC)
+	require.Equal(time.Date(2020, 1, 1, 10, 0, 10, 0, time.UTC), nextTick(now, 5*time.Second))
+	require.Equal(time.Date(2020, 1, 1, 10, 1, 0, 0, time.UTC), nextTick(now, time.Minute))
+}
@@ -2,6 +2,7 @@ package machinestats
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"regexp"
@@ -18,6 +19,8 @@ var totalSessionsPattern = regexp.MustCompile(`Total sessions: (?P<numSessions>\
 
 // CoturnStat measures coturn statistics
 type CoturnStat struct {
+	// name tells instances apart when several Coturn servers are monitored
+	name     string
 	host     string
 	port     int
 	password string
@@ -116,13 +119,27 @@ func (c *CoturnStat) login() error {
 	return err
 }
 
-func (c *CoturnStat) get() (uint64, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", c.host, c.port))
+func (c *CoturnStat) get(ctx context.Context) (uint64, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%v:%v", c.host, c.port))
 	if err != nil {
 		log.Errorf("Failed to connect to coturn server: %v", err)
 		return 0, err
 	}
 	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Unblock any pending reads and writes if ctx is cancelled
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
 
 	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
@@ -169,12 +186,21 @@ func (c *CoturnStat) get() (uint64, error) {
 }
 
 type coturnStatMeasurement struct {
+	prefix      string
 	numSessions uint64
+	timestamp   int64
 }
 
 // NewCoturnStat returns a coturn statistics measurer
 func NewCoturnStat(host string, port int, password string) (*CoturnStat, error) {
+	return NewNamedCoturnStat("", host, port, password)
+}
+
+// NewNamedCoturnStat returns a coturn statistics measurer whose measurements
+// are reported under coturn.<name> so that several servers can be monitored
+func NewNamedCoturnStat(name string, host string, port int, password string) (*CoturnStat, error) {
 	stats := &CoturnStat{
+		name,
 		host,
 		port,
 		password,
@@ -186,12 +212,23 @@ func NewCoturnStat(host string, port int, password string) (*CoturnStat, error)
 
 // Name of this stat
 func (c *CoturnStat) Name() string {
+	if c.name != "" {
+		return fmt.Sprintf("coturn-stats.%v", c.name)
+	}
 	return "coturn-stats"
 }
 
+// prefix of the measurements' names
+func (c *CoturnStat) prefix() string {
+	if c.name != "" {
+		return fmt.Sprintf("coturn.%v", c.name)
+	}
+	return "coturn"
+}
+
 // Name of the stat
 func (c *coturnStatMeasurement) Name() string {
-	return "coturn.numSessions"
+	return fmt.Sprintf("%v.numSessions", c.prefix)
 }
 
 // Type of stat
@@ -203,15 +240,48 @@ func (c *coturnStatMeasurement) Value() interface{} {
 	return c.numSessions
 }
 
+// Unit of stat
+func (c *coturnStatMeasurement) Unit() Unit {
+	return UnitNone
+}
+
+// Description of stat
+func (c *coturnStatMeasurement) Description() string {
+	return "Sessions open on the Coturn server"
+}
+
+// Timestamp at which the sessions were counted
+func (c *coturnStatMeasurement) Timestamp() int64 {
+	return c.timestamp
+}
+
 // Measure returns the number of open sockets
 func (c *CoturnStat) Measure(channel chan<- Measurement) error {
-	numSessions, err := c.get()
+	return c.MeasureContext(context.Background(), channel)
+}
+
+// MeasureContext returns the number of open sockets, giving up once ctx is
+// done
+func (c *CoturnStat) MeasureContext(ctx context.Context, channel chan<- Measurement) error {
+	start := time.Now()
+	numSessions, err := c.get(ctx)
 	if err != nil {
 		log.Errorf("Failed to get coturn stat: %v\n", err)
 		return err
 	}
+	now := nowFn()
 	channel <- &coturnStatMeasurement{
+		c.prefix(),
 		numSessions,
+		now,
+	}
+	channel <- &BasicMeasurement{
+		name:            fmt.Sprintf("%v.latency", c.prefix()),
+		measurementType: Timing,
+		value:           float64(time.Since(start)) / float64(time.Millisecond),
+		timestamp:       now,
+		unit:            UnitMilliseconds,
+		description:     "Time taken to query the Coturn CLI",
 	}
 	return nil
 }
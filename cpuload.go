@@ -62,8 +62,9 @@ func NewCPULoadStat(fs *procfs.FS) (*CPULoadStat, error) {
 }
 
 type cpuBusyMeasurement struct {
-	cpu      int
-	busyness float64
+	cpu       int
+	busyness  float64
+	timestamp int64
 }
 
 // Name of the measurement
@@ -80,6 +81,35 @@ func (c *cpuBusyMeasurement) Value() interface{} {
 	return c.busyness
 }
 
+// Timestamp at which the load was read
+func (c *cpuBusyMeasurement) Timestamp() int64 {
+	return c.timestamp
+}
+
+// Unit of the measurement
+func (c *cpuBusyMeasurement) Unit() Unit {
+	return UnitRatio
+}
+
+// Description of the measurement
+func (c *cpuBusyMeasurement) Description() string {
+	return "Fraction of time the CPU was busy"
+}
+
+// Family of the measurement
+func (c *cpuBusyMeasurement) Family() string {
+	return "cpu-load"
+}
+
+// Labels of the measurement
+func (c *cpuBusyMeasurement) Labels() map[string]string {
+	cpu := "total"
+	if c.cpu >= 0 {
+		cpu = fmt.Sprintf("%02d", c.cpu)
+	}
+	return map[string]string{"cpu": cpu}
+}
+
 // Name of this stat
 func (c *CPULoadStat) Name() string {
 	return "cpu-load-stat"
@@ -91,6 +121,7 @@ func (c *CPULoadStat) Measure(channel chan<- Measurement) error {
 	if err != nil {
 		return err
 	}
+	now := nowFn()
 	cpuStatArray := make([]*CPUStat, len(stat.CPU)+1) // + 1 for the total
 	cpuStatArray[0] = newCPUStat(&stat.CPUTotal)
 	for idx, entry := range stat.CPU {
@@ -108,6 +139,7 @@ func (c *CPULoadStat) Measure(channel chan<- Measurement) error {
 		m := &cpuBusyMeasurement{
 			idx - 1,
 			busyness,
+			now,
 		}
 		channel <- m
 	}
@@ -0,0 +1,346 @@
+package machinestats
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FileFormatJSON writes one JSON object per collection cycle
+	FileFormatJSON = "json"
+	// FileFormatCSV writes one CSV row per collection cycle
+	FileFormatCSV = "csv"
+)
+
+// FileSinkConfig configures a FileSink
+type FileSinkConfig struct {
+	// Path of the file that is appended to
+	Path string
+	// Format is either FileFormatJSON or FileFormatCSV
+	Format string
+	// MaxSize is the size in bytes after which the file is rotated. 0 disables
+	// size based rotation.
+	MaxSize int64
+	// MaxAge is the duration after which the file is rotated. 0 disables age
+	// based rotation.
+	MaxAge time.Duration
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// FileSink records every collection cycle to a file. Everything written
+// between two calls to Flush makes up one cycle and ends up on one line.
+//
+// Measurements that carry a timestamp keep it: JSON records list them under
+// "timestamps" and a CSV row is stamped with the newest measurement in it. The
+// record's timestamp falls back to the time of the Flush otherwise.
+//
+// CSV files have a column for every metric that was written to them, in
+// sorted order. Metrics that a cycle does not report are left empty. When a
+// metric shows up for the first time the file is rotated and the new file
+// starts with a header that has every column so far.
+type FileSink struct {
+	config     FileSinkConfig
+	file       *os.File
+	size       int64
+	opened     int64
+	header     []string
+	names      []string
+	values     map[string]interface{}
+	timestamps map[string]int64
+	pending    bool
+}
+
+// NewFileSink creates a FileSink, appending to the file if it already exists
+func NewFileSink(config FileSinkConfig) (*FileSink, error) {
+	switch config.Format {
+	case "":
+		config.Format = FileFormatJSON
+	case FileFormatJSON, FileFormatCSV:
+	default:
+		return nil, fmt.Errorf("unsupported file format '%v'", config.Format)
+	}
+	f := &FileSink{
+		config:     config,
+		values:     make(map[string]interface{}),
+		timestamps: make(map[string]int64),
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write adds the measurements to the current cycle
+func (f *FileSink) Write(measurements []Measurement) error {
+	for _, m := range measurements {
+		name := m.Name()
+		if _, ok := f.values[name]; !ok {
+			f.names = append(f.names, name)
+		}
+		f.values[name] = m.Value()
+		if timestamp := measurementTime(m, 0); timestamp != 0 {
+			f.timestamps[name] = timestamp
+		} else {
+			delete(f.timestamps, name)
+		}
+	}
+	f.pending = true
+	return nil
+}
+
+// Flush appends the current cycle to the file, rotating it first if needed
+func (f *FileSink) Flush() error {
+	if !f.pending {
+		return nil
+	}
+	now := nowFn()
+	values := f.values
+	names := f.names
+	timestamps := f.timestamps
+	f.values = make(map[string]interface{})
+	f.timestamps = make(map[string]int64)
+	f.names = nil
+	f.pending = false
+
+	var record []byte
+	var err error
+	changed := false
+	switch f.config.Format {
+	case FileFormatCSV:
+		names, changed = f.csvColumns(names)
+		record, err = f.csvRecord(newestTimestamp(timestamps, now), names, values)
+	default:
+		record, err = jsonRecord(now, values, timestamps)
+	}
+	if err != nil {
+		return err
+	}
+
+	if changed || f.shouldRotate(now, int64(len(record))) {
+		if err := f.rotate(now); err != nil {
+			return err
+		}
+		if f.config.Format == FileFormatCSV {
+			record, err = f.csvRecord(newestTimestamp(timestamps, now), names, values)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	n, err := f.file.Write(record)
+	f.size += int64(n)
+	return err
+}
+
+// Close writes any pending cycle and closes the file
+func (f *FileSink) Close() error {
+	err := f.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.config.Path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open '%v': %w", f.config.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = nowFn()
+	f.header = nil
+	if f.config.Format == FileFormatCSV && f.size > 0 {
+		// Pick up the header of the existing file
+		line, err := bufio.NewReader(io.NewSectionReader(file, 0, f.size)).ReadString('\n')
+		if err != nil && err != io.EOF {
+			file.Close()
+			return err
+		}
+		header, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil && err != io.EOF {
+			file.Close()
+			return fmt.Errorf("failed to read the header of '%v': %w", f.config.Path, err)
+		}
+		if len(header) > 0 {
+			f.header = header[1:]
+		}
+	}
+	return nil
+}
+
+func (f *FileSink) shouldRotate(now int64, recordSize int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.config.MaxSize > 0 && f.size+recordSize > f.config.MaxSize {
+		return true
+	}
+	if f.config.MaxAge > 0 && time.Duration(now-f.opened) >= f.config.MaxAge {
+		return true
+	}
+	return false
+}
+
+// rotate moves the current file aside, optionally compresses it, and opens a
+// fresh file in its place
+func (f *FileSink) rotate(now int64) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%v.%v", f.config.Path, time.Unix(0, now).UTC().Format("20060102T150405.000Z"))
+	for idx := 1; fileExists(rotated) || fileExists(rotated+".gz"); idx++ {
+		rotated = fmt.Sprintf("%v.%v.%v", f.config.Path, time.Unix(0, now).UTC().Format("20060102T150405.000Z"), idx)
+	}
+	if err := os.Rename(f.config.Path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate '%v': %w", f.config.Path, err)
+	}
+	log.Debugf("Rotated %v to %v", f.config.Path, rotated)
+	if f.config.Compress {
+		if err := gzipFile(rotated); err != nil {
+			log.Errorf("Failed to compress %v: %v", rotated, err)
+		}
+	}
+	return f.open()
+}
+
+// newestTimestamp returns the newest of the timestamps, or fallback if there
+// are none
+func newestTimestamp(timestamps map[string]int64, fallback int64) int64 {
+	if len(timestamps) == 0 {
+		return fallback
+	}
+	var newest int64
+	for _, timestamp := range timestamps {
+		if timestamp > newest {
+			newest = timestamp
+		}
+	}
+	return newest
+}
+
+// csvColumns returns the columns of the file once names have been added to
+// them and whether any of the names are new to a file that has a header
+func (f *FileSink) csvColumns(names []string) ([]string, bool) {
+	if f.header == nil {
+		sort.Strings(names)
+		return names, false
+	}
+	columns := append([]string{}, f.header...)
+	known := make(map[string]bool, len(columns))
+	for _, name := range columns {
+		known[name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			known[name] = true
+			columns = append(columns, name)
+		}
+	}
+	if len(columns) == len(f.header) {
+		return f.header, false
+	}
+	sort.Strings(columns)
+	return columns, true
+}
+
+func (f *FileSink) csvRecord(now int64, names []string, values map[string]interface{}) ([]byte, error) {
+	buf := strings.Builder{}
+	w := csv.NewWriter(&buf)
+	if f.header == nil {
+		if err := w.Write(append([]string{"timestamp"}, names...)); err != nil {
+			return nil, err
+		}
+		f.header = names
+	}
+	row := make([]string, len(names)+1)
+	row[0] = fmt.Sprintf("%v", time.Duration(now).Milliseconds())
+	for idx, name := range names {
+		if value, ok := values[name]; ok {
+			row[idx+1] = fmt.Sprintf("%v", value)
+		}
+	}
+	if err := w.Write(row); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return []byte(buf.String()), w.Error()
+}
+
+func jsonRecord(now int64, values map[string]interface{}, timestamps map[string]int64) ([]byte, error) {
+	data := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		data[k] = jsonSafeValue(v)
+	}
+	record := map[string]interface{}{
+		"timestamp": time.Duration(now).Milliseconds(),
+		"data":      data,
+	}
+	if len(timestamps) > 0 {
+		millis := make(map[string]int64, len(timestamps))
+		for k, v := range timestamps {
+			millis[k] = time.Duration(v).Milliseconds()
+		}
+		record["timestamps"] = millis
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// jsonSafeValue replaces values that cannot be represented in JSON with nil
+func jsonSafeValue(value interface{}) interface{} {
+	if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return nil
+	}
+	return value
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
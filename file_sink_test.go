@@ -0,0 +1,244 @@
+package machinestats
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSinkJSON(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	nowFn = func() int64 { return int64(2 * time.Second) }
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "stats.jsonl")
+
+	sink, err := NewFileSink(FileSinkConfig{Path: filePath})
+	require.Nil(err)
+
+	require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.0}}))
+	require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "cpu-load.-1", measurementType: Gauge, value: math.NaN()}}))
+	require.Nil(sink.Flush())
+	// Flushing without new measurements does not write anything
+	require.Nil(sink.Flush())
+	require.Nil(sink.Close())
+
+	b, err := ioutil.ReadFile(filePath)
+	require.Nil(err)
+	require.Equal(`{"data":{"cpu-load.-1":null,"memory-load":50},"timestamp":2000}`+"\n", string(b))
+
+	// Reopening appends
+	sink, err = NewFileSink(FileSinkConfig{Path: filePath})
+	require.Nil(err)
+	require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 60.0}}))
+	require.Nil(sink.Close())
+	b, err = ioutil.ReadFile(filePath)
+	require.Nil(err)
+	require.Equal(2, strings.Count(string(b), "\n"))
+}
+
+func TestFileSinkCSV(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	now := int64(time.Second)
+	nowFn = func() int64 { return now }
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "stats.csv")
+
+	sink, err := NewFileSink(FileSinkConfig{Path: filePath, Format: FileFormatCSV})
+	require.Nil(err)
+
+	cycle := func(values map[string]interface{}) {
+		batch := make([]Measurement, 0)
+		for k, v := range values {
+			batch = append(batch, &BasicMeasurement{name: k, measurementType: Gauge, value: v})
+		}
+		require.Nil(sink.Write(batch))
+		require.Nil(sink.Flush())
+		now += int64(time.Second)
+	}
+	cycle(map[string]interface{}{"b": 2, "a": 1.5})
+	cycle(map[string]interface{}{"a": 3, "b": "x,y"})
+	// Metrics that are not reported are left empty
+	cycle(map[string]interface{}{"a": 4})
+	// A new metric starts a new file that keeps the previous columns
+	cycle(map[string]interface{}{"a": 5, "b": 6, "c": 7})
+	cycle(map[string]interface{}{"c": 8})
+	require.Nil(sink.Close())
+
+	rotated, err := filepath.Glob(filePath + ".*")
+	require.Nil(err)
+	require.Len(rotated, 1)
+	b, err := ioutil.ReadFile(rotated[0])
+	require.Nil(err)
+	require.Equal("timestamp,a,b\n1000,1.5,2\n2000,3,\"x,y\"\n3000,4,\n", string(b))
+	b, err = ioutil.ReadFile(filePath)
+	require.Nil(err)
+	require.Equal("timestamp,a,b,c\n4000,5,6,7\n5000,,,8\n", string(b))
+
+	// Existing headers are picked up when reopening
+	sink, err = NewFileSink(FileSinkConfig{Path: filePath, Format: FileFormatCSV})
+	require.Nil(err)
+	cycle(map[string]interface{}{"a": 9})
+	cycle(map[string]interface{}{"a": 10, "0": 11})
+	require.Nil(sink.Close())
+	rotated, err = filepath.Glob(filePath + ".*")
+	require.Nil(err)
+	require.Len(rotated, 2)
+	b, err = ioutil.ReadFile(rotated[1])
+	require.Nil(err)
+	require.Equal("timestamp,a,b,c\n4000,5,6,7\n5000,,,8\n6000,9,,\n", string(b))
+	b, err = ioutil.ReadFile(filePath)
+	require.Nil(err)
+	require.Equal("timestamp,0,a,b,c\n7000,11,10,,\n", string(b))
+}
+
+func TestFileSinkTimestamps(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	nowFn = func() int64 { return int64(5 * time.Second) }
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	batch := []Measurement{
+		&BasicMeasurement{name: "a", measurementType: Gauge, value: 1, timestamp: int64(2 * time.Second)},
+		&BasicMeasurement{name: "b", measurementType: Gauge, value: 2, timestamp: int64(3 * time.Second)},
+		&BasicMeasurement{name: "c", measurementType: Gauge, value: 3},
+	}
+
+	jsonPath := path.Join(dir, "stats.jsonl")
+	sink, err := NewFileSink(FileSinkConfig{Path: jsonPath})
+	require.Nil(err)
+	require.Nil(sink.Write(batch))
+	require.Nil(sink.Close())
+	b, err := ioutil.ReadFile(jsonPath)
+	require.Nil(err)
+	require.Equal(`{"data":{"a":1,"b":2,"c":3},"timestamp":5000,"timestamps":{"a":2000,"b":3000}}`+"\n", string(b))
+
+	csvPath := path.Join(dir, "stats.csv")
+	sink, err = NewFileSink(FileSinkConfig{Path: csvPath, Format: FileFormatCSV})
+	require.Nil(err)
+	require.Nil(sink.Write(batch))
+	require.Nil(sink.Close())
+	b, err = ioutil.ReadFile(csvPath)
+	require.Nil(err)
+	require.Equal("timestamp,a,b,c\n3000,1,2,3\n", string(b))
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	nowFn = func() int64 { return now }
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "stats.jsonl")
+
+	sink, err := NewFileSink(FileSinkConfig{
+		Path:     filePath,
+		MaxSize:  120,
+		MaxAge:   time.Minute,
+		Compress: true,
+	})
+	require.Nil(err)
+
+	write := func() {
+		require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.0}}))
+		require.Nil(sink.Flush())
+	}
+	// Each record is ~55 bytes, so the third one triggers a size rotation
+	write()
+	write()
+	now += int64(time.Second)
+	write()
+	// Age based rotation
+	now += int64(time.Minute)
+	write()
+	require.Nil(sink.Close())
+
+	rotated, err := filepath.Glob(filePath + ".*.gz")
+	require.Nil(err)
+	require.Equal(2, len(rotated))
+	require.Equal(filePath+".20200101T000001.000Z.gz", rotated[0])
+
+	f, err := os.Open(rotated[0])
+	require.Nil(err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.Nil(err)
+	b, err := io.ReadAll(gz)
+	require.Nil(err)
+	require.Equal(2, strings.Count(string(b), "\n"))
+
+	b, err = ioutil.ReadFile(filePath)
+	require.Nil(err)
+	require.Equal(1, strings.Count(string(b), "\n"))
+}
+
+func TestFileSinkWithStatIntervals(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "stats.csv")
+
+	sink, err := NewFileSink(FileSinkConfig{Path: filePath, Format: FileFormatCSV})
+	require.Nil(err)
+	collector := NewCollector(time.Second, sink)
+	collector.Register(&fakeStat{name: "fast", values: map[string]interface{}{"fast.value": 1}})
+	collector.RegisterWithInterval(time.Minute, &fakeStat{name: "slow", values: map[string]interface{}{"slow.value": 2}})
+	collector.Register(&fakeStat{name: "broken", err: fmt.Errorf("boom")})
+
+	// Stats with longer intervals are only part of some cycles
+	stats := collector.all()
+	for idx := 0; idx < 7; idx++ {
+		due := stats[:1]
+		if idx%3 == 0 {
+			due = stats
+		}
+		collector.collect(context.Background(), due)
+	}
+	require.Nil(sink.Close())
+
+	rotated, err := filepath.Glob(filePath + ".*")
+	require.Nil(err)
+	require.Empty(rotated)
+	b, err := ioutil.ReadFile(filePath)
+	require.Nil(err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Equal(8, len(lines))
+	require.Equal("timestamp,fast.value,machinestatsd.errors.broken,slow.value", lines[0])
+	for _, line := range lines {
+		require.Equal(3, strings.Count(line, ","), line)
+	}
+}
@@ -0,0 +1,137 @@
+package machinestats
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultGraphiteBufferSize = 10000
+	defaultGraphiteTimeout    = 5 * time.Second
+)
+
+// GraphiteConfig configures a GraphiteSink
+type GraphiteConfig struct {
+	// Address of the Carbon plaintext listener (host:port)
+	Address string
+	// Prefix prepended to every metric path
+	Prefix string
+	// BufferSize is the maximum number of lines kept in memory while the
+	// Carbon listener is unreachable. The oldest lines are dropped first.
+	BufferSize int
+	// Timeout for connecting and writing
+	Timeout time.Duration
+}
+
+// GraphiteSink writes measurements to Carbon using the plaintext protocol.
+// Lines that cannot be sent are kept in a bounded buffer and retried on the
+// next Flush, reconnecting as needed.
+type GraphiteSink struct {
+	config  GraphiteConfig
+	conn    net.Conn
+	lines   []string
+	dropped uint64
+}
+
+// NewGraphiteSink creates a GraphiteSink. The connection is established lazily
+// on the first Flush.
+func NewGraphiteSink(config GraphiteConfig) *GraphiteSink {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultGraphiteBufferSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultGraphiteTimeout
+	}
+	config.Prefix = strings.TrimSuffix(config.Prefix, ".")
+	return &GraphiteSink{
+		config: config,
+		lines:  make([]string, 0),
+	}
+}
+
+// Write buffers the measurements as plaintext lines
+func (g *GraphiteSink) Write(measurements []Measurement) error {
+	now := nowFn()
+	for _, m := range measurements {
+		if m.Type() == Set {
+			// Counting unique members is left to backends that support sets
+			continue
+		}
+		value, ok := toFloat64(m.Value())
+		if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		timestamp := time.Duration(measurementTime(m, now))
+		line := fmt.Sprintf("%v %v %v\n", g.path(m.Name()), strconv.FormatFloat(value, 'f', -1, 64), int64(timestamp/time.Second))
+		g.lines = append(g.lines, line)
+	}
+	if overflow := len(g.lines) - g.config.BufferSize; overflow > 0 {
+		g.lines = g.lines[overflow:]
+		g.dropped += uint64(overflow)
+		log.Warnf("Graphite buffer full, dropped %v lines", overflow)
+	}
+	return nil
+}
+
+// Flush sends all buffered lines. If the send fails the connection is closed
+// and the lines that were not sent in full stay buffered for the next attempt.
+func (g *GraphiteSink) Flush() error {
+	if len(g.lines) == 0 {
+		return nil
+	}
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.config.Address, g.config.Timeout)
+		if err != nil {
+			return fmt.Errorf("failed to connect to graphite: %w", err)
+		}
+		g.conn = conn
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(g.config.Timeout))
+	if n, err := g.conn.Write([]byte(strings.Join(g.lines, ""))); err != nil {
+		g.conn.Close()
+		g.conn = nil
+		// Carbon discards the truncated line, so only the complete ones were
+		// delivered
+		sent := 0
+		for sent < len(g.lines) && n >= len(g.lines[sent]) {
+			n -= len(g.lines[sent])
+			sent++
+		}
+		g.lines = append(g.lines[:0], g.lines[sent:]...)
+		return fmt.Errorf("failed to write to graphite: %w", err)
+	}
+	g.lines = g.lines[:0]
+	return nil
+}
+
+// Close flushes buffered lines and closes the connection
+func (g *GraphiteSink) Close() error {
+	err := g.Flush()
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+	return err
+}
+
+// Dropped returns the number of lines that were discarded because the buffer
+// was full
+func (g *GraphiteSink) Dropped() uint64 {
+	return g.dropped
+}
+
+var graphitePathReplacer = strings.NewReplacer(" ", "_", "\t", "_", "\n", "_")
+
+func (g *GraphiteSink) path(name string) string {
+	name = graphitePathReplacer.Replace(name)
+	if g.config.Prefix == "" {
+		return name
+	}
+	return fmt.Sprintf("%v.%v", g.config.Prefix, name)
+}
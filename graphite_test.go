@@ -0,0 +1,140 @@
+package machinestats
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphiteSink(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	nowFn = func() int64 { return int64(1600000000 * time.Second) }
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	addr := listener.Addr().String()
+
+	lines := make(chan string, 10)
+	accept := func(l net.Listener) {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}
+	go accept(listener)
+
+	sink := NewGraphiteSink(GraphiteConfig{
+		Address:    addr,
+		Prefix:     "prod.10-0-0-1.",
+		BufferSize: 2,
+	})
+
+	require.Nil(sink.Write([]Measurement{
+		&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.5},
+		&BasicMeasurement{name: "app version", measurementType: Gauge, value: "v1"},
+	}))
+	require.Nil(sink.Flush())
+	require.Equal("prod.10-0-0-1.memory-load 50.5 1600000000", <-lines)
+
+	// Take the listener down and make sure lines are buffered
+	listener.Close()
+	sink.conn.Close()
+	for idx := 0; idx < 3; idx++ {
+		require.Nil(sink.Write([]Measurement{
+			&BasicMeasurement{name: "connections", measurementType: Gauge, value: idx},
+		}))
+		sink.Flush()
+	}
+	require.NotNil(sink.Flush())
+	require.Equal(2, len(sink.lines))
+	require.Equal(uint64(1), sink.Dropped())
+
+	// Bring the listener back and make sure buffered lines are delivered
+	listener, err = net.Listen("tcp", addr)
+	require.Nil(err)
+	defer listener.Close()
+	go accept(listener)
+
+	require.Nil(sink.Flush())
+	require.Equal("prod.10-0-0-1.connections 1 1600000000", <-lines)
+	require.Equal("prod.10-0-0-1.connections 2 1600000000", <-lines)
+	require.Nil(sink.Close())
+}
+
+// partialConn accepts the first n bytes written to it and fails afterwards
+type partialConn struct {
+	net.Conn
+	n int
+}
+
+func (c *partialConn) Write(b []byte) (int, error) {
+	if len(b) > c.n {
+		return c.n, fmt.Errorf("connection reset")
+	}
+	c.n -= len(b)
+	return len(b), nil
+}
+
+func (c *partialConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *partialConn) Close() error {
+	return nil
+}
+
+func TestGraphiteSinkPartialWrite(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	nowFn = func() int64 { return int64(1600000000 * time.Second) }
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	sink := NewGraphiteSink(GraphiteConfig{Address: listener.Addr().String()})
+	require.Nil(sink.Write([]Measurement{
+		&BasicMeasurement{name: "a", measurementType: Gauge, value: 1},
+		&BasicMeasurement{name: "b", measurementType: Gauge, value: 2},
+		&BasicMeasurement{name: "c", measurementType: Gauge, value: 3},
+	}))
+	// The connection breaks halfway through the second line
+	sink.conn = &partialConn{n: len("a 1 1600000000\n") + 3}
+	require.Error(sink.Flush())
+	require.Nil(sink.conn)
+
+	// Only the lines that were not sent in full are sent again
+	require.Nil(sink.Close())
+	received := make([]string, 0)
+	for line := range lines {
+		received = append(received, line)
+	}
+	require.Equal([]string{"b 2 1600000000", "c 3 1600000000"}, received)
+}
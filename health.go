@@ -0,0 +1,146 @@
+package machinestats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	defaultReadinessStaleIntervals = 3
+	defaultReadinessMaxErrors      = 3
+)
+
+// ReadinessConfig configures when a collector is considered ready
+type ReadinessConfig struct {
+	// StaleIntervals is how many intervals may pass without a finished cycle,
+	// or without a successful measurement of a required stat, before the
+	// collector is no longer ready. Defaults to 3.
+	StaleIntervals int
+	// RequiredStats are the names of the stats that must be working for the
+	// collector to be ready
+	RequiredStats []string
+	// MaxErrors is the number of consecutive failed measurements after which a
+	// required stat is considered to be failing. Defaults to 3.
+	MaxErrors int
+}
+
+// StatReadiness is the status of a single stat
+type StatReadiness struct {
+	Healthy           bool   `json:"healthy"`
+	Required          bool   `json:"required"`
+	ConsecutiveErrors int    `json:"consecutive_errors"`
+	LastError         string `json:"last_error,omitempty"`
+	// LastSuccess is in milliseconds since the epoch, or 0 if the stat has
+	// never been measured successfully
+	LastSuccess int64 `json:"last_success"`
+}
+
+// Readiness is the status reported by NewReadyHandler
+type Readiness struct {
+	Ready bool `json:"ready"`
+	// Reasons explains why the collector is not ready
+	Reasons []string `json:"reasons,omitempty"`
+	// LastCycle is in milliseconds since the epoch, or 0 if no cycle finished
+	LastCycle int64                    `json:"last_cycle"`
+	SinkError string                   `json:"sink_error,omitempty"`
+	Stats     map[string]StatReadiness `json:"stats"`
+}
+
+// CheckReadiness decides whether a collector whose health is given is ready at
+// now. It is not ready if no cycle has finished within StaleIntervals of the
+// shortest stat interval, if any required stat is missing, failing or stale,
+// or if the most recent cycle failed to write to the sink.
+func CheckReadiness(health CollectorHealth, config ReadinessConfig, now time.Time) Readiness {
+	if config.StaleIntervals <= 0 {
+		config.StaleIntervals = defaultReadinessStaleIntervals
+	}
+	if config.MaxErrors <= 0 {
+		config.MaxErrors = defaultReadinessMaxErrors
+	}
+	required := make(map[string]bool, len(config.RequiredStats))
+	for _, name := range config.RequiredStats {
+		required[name] = true
+	}
+
+	readiness := Readiness{
+		SinkError: health.LastSinkError,
+		Stats:     make(map[string]StatReadiness, len(health.Stats)),
+	}
+	reasons := make([]string, 0)
+	var shortest time.Duration
+	for name, stat := range health.Stats {
+		if shortest == 0 || stat.Interval < shortest {
+			shortest = stat.Interval
+		}
+		status := StatReadiness{
+			Healthy:           true,
+			Required:          required[name],
+			ConsecutiveErrors: stat.ConsecutiveErrors,
+			LastError:         stat.LastError,
+		}
+		if !stat.LastSuccess.IsZero() {
+			status.LastSuccess = stat.LastSuccess.UnixNano() / int64(time.Millisecond)
+		}
+		switch {
+		case stat.ConsecutiveErrors >= config.MaxErrors:
+			status.Healthy = false
+			if status.Required {
+				reasons = append(reasons, fmt.Sprintf("stat %v failed %v times in a row", name, stat.ConsecutiveErrors))
+			}
+		case stat.LastSuccess.IsZero() || now.Sub(stat.LastSuccess) > time.Duration(config.StaleIntervals)*stat.Interval:
+			status.Healthy = false
+			if status.Required {
+				reasons = append(reasons, fmt.Sprintf("stat %v has not been measured successfully recently", name))
+			}
+		}
+		readiness.Stats[name] = status
+	}
+	for name := range required {
+		if _, ok := health.Stats[name]; !ok {
+			reasons = append(reasons, fmt.Sprintf("stat %v is not registered", name))
+		}
+	}
+	sort.Strings(reasons)
+
+	if health.LastCycle.IsZero() {
+		reasons = append([]string{"no collection has finished yet"}, reasons...)
+	} else {
+		readiness.LastCycle = health.LastCycle.UnixNano() / int64(time.Millisecond)
+		if shortest > 0 && now.Sub(health.LastCycle) > time.Duration(config.StaleIntervals)*shortest {
+			reasons = append([]string{fmt.Sprintf("no collection has finished since %v", health.LastCycle.Format(time.RFC3339))}, reasons...)
+		}
+	}
+	if health.LastSinkError != "" {
+		reasons = append(reasons, "the sink failed during the last collection")
+	}
+	if len(reasons) > 0 {
+		readiness.Reasons = reasons
+	}
+	readiness.Ready = len(reasons) == 0
+	return readiness
+}
+
+// NewHealthHandler returns a handler that reports that the process is alive
+func NewHealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+}
+
+// NewReadyHandler returns a handler that serves the collector's Readiness as
+// JSON, with a 503 status code if it is not ready
+func NewReadyHandler(collector *Collector, config ReadinessConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readiness := CheckReadiness(collector.Health(), config, time.Now())
+		b, _ := json.Marshal(readiness)
+		w.Header().Set("Content-Type", "application/json")
+		if !readiness.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(b)
+	})
+}
@@ -0,0 +1,91 @@
+package machinestats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReadiness(t *testing.T) {
+	require := require.New(t)
+
+	sink := &mockSink{}
+	collector := NewCollector(time.Second, sink)
+	good := &fakeStat{name: "good", values: map[string]interface{}{"good.value": 1}}
+	bad := &fakeStat{name: "bad", err: fmt.Errorf("boom")}
+	collector.Register(good, bad)
+	config := ReadinessConfig{RequiredStats: []string{"good"}, MaxErrors: 2}
+
+	// Nothing has been collected yet
+	readiness := CheckReadiness(collector.Health(), config, time.Now())
+	require.False(readiness.Ready)
+	require.Equal("no collection has finished yet", readiness.Reasons[0])
+
+	collector.Collect()
+	readiness = CheckReadiness(collector.Health(), config, time.Now())
+	require.True(readiness.Ready, readiness.Reasons)
+	require.True(readiness.Stats["good"].Healthy)
+	require.True(readiness.Stats["good"].Required)
+	require.False(readiness.Stats["bad"].Healthy)
+	require.Equal("boom", readiness.Stats["bad"].LastError)
+
+	// Stats that are not required do not matter
+	collector.Collect()
+	readiness = CheckReadiness(collector.Health(), config, time.Now())
+	require.True(readiness.Ready)
+	require.Equal(2, readiness.Stats["bad"].ConsecutiveErrors)
+
+	// Required stats that are failing do
+	config.RequiredStats = append(config.RequiredStats, "bad", "missing")
+	readiness = CheckReadiness(collector.Health(), config, time.Now())
+	require.False(readiness.Ready)
+	require.Equal([]string{"stat bad failed 2 times in a row", "stat missing is not registered"}, readiness.Reasons)
+
+	// A stuck collector is not ready
+	config.RequiredStats = []string{"good"}
+	readiness = CheckReadiness(collector.Health(), config, time.Now().Add(5*time.Second))
+	require.False(readiness.Ready)
+	require.Len(readiness.Reasons, 2)
+
+	// Neither is one whose sink is down
+	sink.writeErr = fmt.Errorf("down")
+	collector.Collect()
+	readiness = CheckReadiness(collector.Health(), config, time.Now())
+	require.False(readiness.Ready)
+	require.Equal("down", readiness.SinkError)
+	sink.writeErr = nil
+	collector.Collect()
+	require.True(CheckReadiness(collector.Health(), config, time.Now()).Ready)
+}
+
+func TestHealthHandlers(t *testing.T) {
+	require := require.New(t)
+
+	w := httptest.NewRecorder()
+	NewHealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(200, w.Code)
+	require.JSONEq(`{"status": "ok"}`, w.Body.String())
+
+	collector := NewCollector(time.Second, &mockSink{})
+	collector.Register(&fakeStat{name: "a", values: map[string]interface{}{"a.value": 1}})
+	handler := NewReadyHandler(collector, ReadinessConfig{RequiredStats: []string{"a"}})
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	require.Equal(503, w.Code)
+
+	collector.Collect()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	require.Equal(200, w.Code)
+	require.Equal("application/json", w.Header().Get("Content-Type"))
+	var readiness Readiness
+	require.Nil(json.Unmarshal(w.Body.Bytes(), &readiness))
+	require.True(readiness.Ready)
+	require.True(readiness.Stats["a"].Healthy)
+	require.NotZero(readiness.LastCycle)
+}
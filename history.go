@@ -0,0 +1,234 @@
+package machinestats
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHistoryDuration = 10 * time.Minute
+	defaultHistoryPoints   = 600
+)
+
+// HistoryConfig configures a History
+type HistoryConfig struct {
+	// Duration for which points are kept. Defaults to 10 minutes.
+	Duration time.Duration
+	// Points is the maximum number of points kept per metric. Defaults to 600.
+	Points int
+}
+
+// HistoryPoint is a single numeric value of a metric
+type HistoryPoint struct {
+	// Timestamp at which the value was measured, in nanoseconds since the epoch
+	Timestamp int64
+	Value     float64
+}
+
+// MarshalJSON encodes the point as a [timestamp in ms, value] pair
+func (p HistoryPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{time.Duration(p.Timestamp).Milliseconds(), jsonSafeValue(p.Value)})
+}
+
+// History is a sink that keeps the recent numeric values of every metric in
+// memory so that they can be looked at without a metrics backend. Every
+// metric has a bounded ring buffer, and points older than the configured
+// duration are dropped.
+type History struct {
+	config HistoryConfig
+	mutex  sync.RWMutex
+	rings  map[string]*historyRing
+}
+
+// historyRing is a fixed size ring buffer of points ordered by time
+type historyRing struct {
+	points []HistoryPoint
+	head   int
+	size   int
+}
+
+// NewHistory creates an empty History
+func NewHistory(config HistoryConfig) (*History, error) {
+	if config.Duration < 0 || config.Points < 0 {
+		return nil, fmt.Errorf("history duration and points must not be negative")
+	}
+	if config.Duration == 0 {
+		config.Duration = defaultHistoryDuration
+	}
+	if config.Points == 0 {
+		config.Points = defaultHistoryPoints
+	}
+	return &History{
+		config: config,
+		rings:  make(map[string]*historyRing),
+	}, nil
+}
+
+// Write records the numeric measurements. Sets and non-numeric values are
+// ignored.
+func (h *History) Write(measurements []Measurement) error {
+	now := nowFn()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, m := range measurements {
+		if m.Type() == Set {
+			continue
+		}
+		value, ok := toFloat64(m.Value())
+		if !ok {
+			continue
+		}
+		ring, ok := h.rings[m.Name()]
+		if !ok {
+			ring = &historyRing{points: make([]HistoryPoint, h.config.Points)}
+			h.rings[m.Name()] = ring
+		}
+		ring.push(HistoryPoint{measurementTime(m, now), value})
+	}
+	return nil
+}
+
+// Flush drops the points that are older than the configured duration
+func (h *History) Flush() error {
+	cutoff := nowFn() - int64(h.config.Duration)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for name, ring := range h.rings {
+		ring.dropBefore(cutoff)
+		if ring.size == 0 {
+			delete(h.rings, name)
+		}
+	}
+	return nil
+}
+
+// Close does nothing, the history is only kept in memory
+func (h *History) Close() error {
+	return nil
+}
+
+// Names returns the sorted names of the metrics that have a history
+func (h *History) Names() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	names := make([]string, 0, len(h.rings))
+	for name := range h.rings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Points returns the points of the metric measured at or after since, which is
+// in nanoseconds since the epoch. Points older than the configured duration
+// are never returned.
+func (h *History) Points(name string, since int64) []HistoryPoint {
+	if cutoff := nowFn() - int64(h.config.Duration); since < cutoff {
+		since = cutoff
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	ring, ok := h.rings[name]
+	if !ok {
+		return nil
+	}
+	points := make([]HistoryPoint, 0, ring.size)
+	for idx := 0; idx < ring.size; idx++ {
+		point := ring.at(idx)
+		if point.Timestamp >= since {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+func (r *historyRing) at(idx int) HistoryPoint {
+	return r.points[(r.head+idx)%len(r.points)]
+}
+
+// push adds a point, overwriting the oldest one if the ring is full
+func (r *historyRing) push(point HistoryPoint) {
+	if r.size < len(r.points) {
+		r.points[(r.head+r.size)%len(r.points)] = point
+		r.size++
+		return
+	}
+	r.points[r.head] = point
+	r.head = (r.head + 1) % len(r.points)
+}
+
+// dropBefore removes the oldest points until the oldest one is at or after
+// cutoff
+func (r *historyRing) dropBefore(cutoff int64) {
+	for r.size > 0 && r.at(0).Timestamp < cutoff {
+		r.head = (r.head + 1) % len(r.points)
+		r.size--
+	}
+}
+
+// parseSince parses the since parameter of the history handler, which is
+// either milliseconds since the epoch, an RFC 3339 time or a duration before
+// now such as 5m
+func parseSince(value string, now int64) (int64, error) {
+	if value == "" {
+		return math.MinInt64, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return int64(time.Duration(ms) * time.Millisecond), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UnixNano(), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid since %q: expected milliseconds since the epoch, an RFC 3339 time or a duration", value)
+	}
+	if d < 0 {
+		d = -d
+	}
+	return now - int64(d), nil
+}
+
+// NewStatsHistoryHandler returns a handler that serves the history of every
+// metric as [timestamp in ms, value] pairs. The metric and regex query
+// parameters select metrics, see metricFilterFromQuery, and the since
+// parameter limits the points to those measured at or after it.
+func NewStatsHistoryHandler(history *History) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		since, err := parseSince(query.Get("since"), nowFn())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter, err := metricFilterFromQuery(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series := make(map[string][]HistoryPoint)
+		for _, name := range history.Names() {
+			if !filter.Match(name) {
+				continue
+			}
+			if points := history.Points(name, since); len(points) > 0 {
+				series[name] = points
+			}
+		}
+		b, err := json.Marshal(map[string]interface{}{
+			"data": series,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
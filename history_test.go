@@ -0,0 +1,116 @@
+package machinestats
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	now := int64(0)
+	nowFn = func() int64 { return now }
+
+	history, err := NewHistory(HistoryConfig{Duration: 10 * time.Second, Points: 5})
+	require.Nil(err)
+
+	for idx := 1; idx <= 8; idx++ {
+		now = int64(time.Duration(idx) * time.Second)
+		require.Nil(history.Write([]Measurement{
+			&cpuBusyMeasurement{-1, float64(idx), now},
+			&BasicMeasurement{name: "users", measurementType: Set, value: "a"},
+			&BasicMeasurement{name: "version", measurementType: Gauge, value: "v1"},
+		}))
+		require.Nil(history.Flush())
+	}
+	// Sets and non-numeric values have no history
+	require.Equal([]string{"cpu-load.-1"}, history.Names())
+
+	// Only the last 5 points are kept
+	points := history.Points("cpu-load.-1", 0)
+	require.Len(points, 5)
+	require.Equal(HistoryPoint{int64(4 * time.Second), 4}, points[0])
+	require.Equal(HistoryPoint{int64(8 * time.Second), 8}, points[4])
+
+	require.Len(history.Points("cpu-load.-1", int64(7*time.Second)), 2)
+	require.Nil(history.Points("missing", 0))
+
+	// Points older than the duration are dropped
+	now = int64(16 * time.Second)
+	require.Len(history.Points("cpu-load.-1", 0), 3)
+	now = int64(20 * time.Second)
+	require.Nil(history.Flush())
+	require.Empty(history.Names())
+
+	_, err = NewHistory(HistoryConfig{Points: -1})
+	require.NotNil(err)
+}
+
+func TestParseSince(t *testing.T) {
+	require := require.New(t)
+
+	now := int64(time.Hour)
+	since, err := parseSince("1500", now)
+	require.Nil(err)
+	require.Equal(int64(1500*time.Millisecond), since)
+
+	since, err = parseSince("5m", now)
+	require.Nil(err)
+	require.Equal(int64(55*time.Minute), since)
+
+	since, err = parseSince("1970-01-01T00:10:00Z", now)
+	require.Nil(err)
+	require.Equal(int64(10*time.Minute), since)
+
+	_, err = parseSince("yesterday", now)
+	require.NotNil(err)
+}
+
+func TestStatsHistoryHandler(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	now := int64(10 * time.Second)
+	nowFn = func() int64 { return now }
+
+	history, err := NewHistory(HistoryConfig{})
+	require.Nil(err)
+	require.Nil(history.Write([]Measurement{
+		&BasicMeasurement{name: "a", measurementType: Gauge, value: 1, timestamp: int64(time.Second)},
+		&BasicMeasurement{name: "a", measurementType: Gauge, value: 2, timestamp: int64(2 * time.Second)},
+		&BasicMeasurement{name: "b", measurementType: Gauge, value: 3},
+	}))
+	handler := NewStatsHistoryHandler(history)
+
+	get := func(url string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		require.Equal(200, w.Code)
+		require.Equal("application/json", w.Header().Get("Content-Type"))
+		var result map[string]interface{}
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &result))
+		return result["data"].(map[string]interface{})
+	}
+
+	require.Equal(map[string]interface{}{
+		"a": []interface{}{[]interface{}{1000.0, 1.0}, []interface{}{2000.0, 2.0}},
+		"b": []interface{}{[]interface{}{10000.0, 3.0}},
+	}, get("/stats/history"))
+	require.Equal(map[string]interface{}{
+		"a": []interface{}{[]interface{}{2000.0, 2.0}},
+	}, get("/stats/history?metric=a&metric=missing&since=2000"))
+	require.Equal(map[string]interface{}{
+		"b": []interface{}{[]interface{}{10000.0, 3.0}},
+	}, get("/stats/history?regex=^b$"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/stats/history?since=bad", nil))
+	require.Equal(400, w.Code)
+}
@@ -1,12 +1,17 @@
 package machinestats
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 )
 
+// defaultHTTPStatTimeout bounds Measure calls that are made without a context
+const defaultHTTPStatTimeout = 30 * time.Second
+
 type HTTPStat struct {
 	url    string
 	name   string
@@ -24,11 +29,29 @@ func (h *HTTPStat) Name() string {
 	return h.name
 }
 
+// Measure fetches the metrics, giving up after defaultHTTPStatTimeout
 func (h *HTTPStat) Measure(channel chan<- Measurement) error {
-	data, err := FetchAndFlattenJSON(h.url)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPStatTimeout)
+	defer cancel()
+	return h.MeasureContext(ctx, channel)
+}
+
+// MeasureContext fetches the metrics, aborting the request once ctx is done
+func (h *HTTPStat) MeasureContext(ctx context.Context, channel chan<- Measurement) error {
+	start := time.Now()
+	data, err := FetchAndFlattenJSONContext(ctx, h.url)
 	if err != nil {
 		return err
 	}
+	now := nowFn()
+	channel <- &BasicMeasurement{
+		name:            fmt.Sprintf("http.%v.latency", h.name),
+		measurementType: Timing,
+		value:           float64(time.Since(start)) / float64(time.Millisecond),
+		timestamp:       now,
+		unit:            UnitMilliseconds,
+		description:     fmt.Sprintf("Time taken to fetch %v", h.url),
+	}
 	for k, v := range data {
 		prefixedName := k
 		if h.prefix != "" {
@@ -38,6 +61,8 @@ func (h *HTTPStat) Measure(channel chan<- Measurement) error {
 			name:            prefixedName,
 			measurementType: Gauge,
 			value:           v,
+			timestamp:       now,
+			description:     fmt.Sprintf("Fetched from %v", h.url),
 		}
 		channel <- m
 	}
@@ -46,10 +71,20 @@ func (h *HTTPStat) Measure(channel chan<- Measurement) error {
 
 // FetchAndFlattenJSON makes a GET request to the given URL and returns a flattened JSON map.
 func FetchAndFlattenJSON(url string) (map[string]interface{}, error) {
+	return FetchAndFlattenJSONContext(context.Background(), url)
+}
+
+// FetchAndFlattenJSONContext is like FetchAndFlattenJSON but aborts the request once ctx is done.
+func FetchAndFlattenJSONContext(ctx context.Context, url string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GET request: %w", err)
+	}
+
 	// Make the GET request
-	resp, err := http.Get(url)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make GET request: %v", err)
+		return nil, fmt.Errorf("failed to make GET request: %w", err)
 	}
 	defer resp.Body.Close()
 
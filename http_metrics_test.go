@@ -1,11 +1,13 @@
 package machinestats
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -103,6 +105,49 @@ func TestFetchAndFlattenJSON_InvalidJSON(t *testing.T) {
 	assert.Contains(t, err.Error(), "failed to unmarshal JSON")
 }
 
+func TestHTTPStatMeasure(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"key": 1}`))
+	}))
+	defer mockServer.Close()
+
+	stat := NewHTTPStat("test", mockServer.URL, "prefix")
+	channel := make(chan Measurement, 2)
+	assert.NoError(t, stat.Measure(channel))
+	close(channel)
+
+	measurements := make(map[string]Measurement)
+	for m := range channel {
+		measurements[m.Name()] = m
+	}
+	assert.Equal(t, float64(1), measurements["prefix.key"].Value())
+	latency := measurements["http.test.latency"]
+	assert.Equal(t, Timing, latency.Type())
+	assert.True(t, latency.Value().(float64) > 0)
+}
+
+func TestHTTPStatMeasureContext(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"key": 1}`))
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	stat := NewHTTPStat("test", mockServer.URL, "prefix")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	channel := make(chan Measurement, 1)
+	start := time.Now()
+	err := stat.MeasureContext(ctx, channel)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Empty(t, channel)
+}
+
 func TestFlattenMap(t *testing.T) {
 	tests := []struct {
 		name     string
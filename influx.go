@@ -0,0 +1,340 @@
+package machinestats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInfluxBatchSize  = 5000
+	defaultInfluxPacketSize = 1400
+	defaultInfluxTimeout    = 10 * time.Second
+)
+
+// InfluxConfig configures an InfluxSink
+type InfluxConfig struct {
+	// URL of the InfluxDB server. udp://host:port sends line protocol as UDP
+	// datagrams. For http(s) URLs, a path of /api/v2/write uses the v2 API and
+	// anything else uses the v1 /write endpoint.
+	URL string
+	// Database to write to with the v1 API
+	Database string
+	// Org, Bucket and Token are used with the v2 API
+	Org    string
+	Bucket string
+	Token  string
+	// Tags added to every point
+	Tags map[string]string
+	// BatchSize is the maximum number of lines sent in a single HTTP request
+	BatchSize int
+	// PacketSize is the maximum size of a UDP datagram
+	PacketSize int
+	// Gzip compresses HTTP request bodies
+	Gzip bool
+	// MaxRetries is the number of later flushes with which a batch that failed
+	// with a network or server error is sent again before it is dropped.
+	// Leave it at 0 behind a SpoolSink, which retries on its own.
+	MaxRetries int
+	// Timeout of each HTTP request
+	Timeout time.Duration
+}
+
+// InfluxSink writes measurements to InfluxDB using the line protocol
+type InfluxSink struct {
+	config   InfluxConfig
+	writeURL string
+	client   *http.Client
+	udpConn  net.Conn
+	lines    []string
+	// retries are the batches that are sent again with the next Flush
+	retries []influxRetry
+}
+
+// influxRetry is a batch of lines that could not be delivered yet
+type influxRetry struct {
+	lines []string
+	// attempts is the number of times sending the batch failed
+	attempts int
+}
+
+// NewInfluxSink creates an InfluxSink from the given config
+func NewInfluxSink(config InfluxConfig) (*InfluxSink, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx url '%v': %w", config.URL, err)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultInfluxBatchSize
+	}
+	if config.PacketSize <= 0 {
+		config.PacketSize = defaultInfluxPacketSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultInfluxTimeout
+	}
+
+	i := &InfluxSink{
+		config: config,
+		lines:  make([]string, 0),
+	}
+
+	switch u.Scheme {
+	case "udp":
+		i.udpConn, err = net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial influx udp endpoint: %w", err)
+		}
+	case "http", "https":
+		query := u.Query()
+		if u.Path == "/api/v2/write" {
+			query.Set("org", config.Org)
+			query.Set("bucket", config.Bucket)
+		} else {
+			u.Path = "/write"
+			query.Set("db", config.Database)
+		}
+		query.Set("precision", "ns")
+		u.RawQuery = query.Encode()
+		i.writeURL = u.String()
+		i.client = &http.Client{Timeout: config.Timeout}
+	default:
+		return nil, fmt.Errorf("unsupported influx url scheme '%v'", u.Scheme)
+	}
+	return i, nil
+}
+
+// Write encodes the measurements as line protocol. Lines are sent once a full
+// batch has accumulated or when Flush is called.
+func (i *InfluxSink) Write(measurements []Measurement) error {
+	now := nowFn()
+	for _, m := range measurements {
+		line, ok := i.encode(m, measurementTime(m, now))
+		if !ok {
+			continue
+		}
+		i.lines = append(i.lines, line)
+	}
+	if len(i.lines) >= i.config.BatchSize {
+		return i.Flush()
+	}
+	return nil
+}
+
+// Flush sends all pending lines. Failed batches are not retried right away,
+// which would hold up the collector for as long as InfluxDB is unreachable,
+// but with the next MaxRetries flushes. Batches that failed with a client
+// error or ran out of retries are dropped. If every failure was a client error
+// the returned error is a PermanentError.
+func (i *InfluxSink) Flush() error {
+	lines := i.lines
+	i.lines = make([]string, 0)
+	if i.udpConn != nil {
+		if len(lines) == 0 {
+			return nil
+		}
+		return i.sendUDP(lines)
+	}
+	batches := i.retries
+	i.retries = nil
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > i.config.BatchSize {
+			n = i.config.BatchSize
+		}
+		batches = append(batches, influxRetry{lines: lines[:n]})
+		lines = lines[n:]
+	}
+
+	var retryErr, rejectErr error
+	unavailable := false
+	for _, batch := range batches {
+		if unavailable {
+			// Keep the order and wait for InfluxDB to come back
+			i.retries = append(i.retries, batch)
+			continue
+		}
+		retry, err := i.sendHTTP(batch.lines)
+		if err == nil {
+			continue
+		}
+		if !retry {
+			if rejectErr == nil {
+				rejectErr = err
+			}
+			continue
+		}
+		if retryErr == nil {
+			retryErr = err
+		}
+		unavailable = true
+		batch.attempts++
+		if batch.attempts > i.config.MaxRetries {
+			if i.config.MaxRetries > 0 {
+				log.Warnf("Dropping %v influx lines after %v attempts", len(batch.lines), batch.attempts)
+			}
+			continue
+		}
+		i.retries = append(i.retries, batch)
+	}
+	if retryErr != nil {
+		return retryErr
+	}
+	if rejectErr != nil {
+		return &PermanentError{rejectErr}
+	}
+	return nil
+}
+
+// Close flushes pending lines and closes the UDP connection, if any
+func (i *InfluxSink) Close() error {
+	err := i.Flush()
+	if i.udpConn != nil {
+		if closeErr := i.udpConn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (i *InfluxSink) sendUDP(lines []string) error {
+	buf := bytes.Buffer{}
+	send := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := i.udpConn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > i.config.PacketSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return send()
+}
+
+// sendHTTP sends a batch of lines and reports whether a failure is worth
+// retrying
+func (i *InfluxSink) sendHTTP(lines []string) (bool, error) {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	if i.config.Gzip {
+		compressed := bytes.Buffer{}
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(body); err != nil {
+			return false, err
+		}
+		if err := gz.Close(); err != nil {
+			return false, err
+		}
+		body = compressed.Bytes()
+	}
+
+	retry, err := i.post(body)
+	if err != nil {
+		return retry, fmt.Errorf("failed to write %v lines to influx: %w", len(lines), err)
+	}
+	return false, nil
+}
+
+// post sends a single request and reports whether a failure is worth retrying
+func (i *InfluxSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, i.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.config.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if i.config.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", i.config.Token))
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %v: %v", resp.Status, strings.TrimSpace(string(msg)))
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// encode converts a measurement to a single line of line protocol
+func (i *InfluxSink) encode(m Measurement, timestamp int64) (string, bool) {
+	if m.Type() == Set {
+		// Counting unique members is left to backends that support sets
+		return "", false
+	}
+	field, ok := formatInfluxField(m.Value())
+	if !ok {
+		return "", false
+	}
+	name := m.Name()
+	tags := make(map[string]string, len(i.config.Tags))
+	for k, v := range i.config.Tags {
+		tags[k] = v
+	}
+	if lm, ok := m.(LabeledMeasurement); ok {
+		name = lm.Family()
+		for k, v := range lm.Labels() {
+			tags[k] = v
+		}
+	}
+	return fmt.Sprintf("%v%v value=%v %v", influxMeasurementEscaper.Replace(name), formatInfluxTags(tags), field, timestamp), true
+}
+
+var influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+var influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func formatInfluxTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k == "" || v == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := strings.Builder{}
+	for _, k := range keys {
+		fmt.Fprintf(&buf, ",%v=%v", influxTagEscaper.Replace(k), influxTagEscaper.Replace(tags[k]))
+	}
+	return buf.String()
+}
+
+func formatInfluxField(value interface{}) (string, bool) {
+	switch val := value.(type) {
+	case string:
+		return fmt.Sprintf(`"%v"`, influxStringEscaper.Replace(val)), true
+	case bool:
+		return strconv.FormatBool(val), true
+	}
+	f, ok := toFloat64(value)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), true
+}
@@ -0,0 +1,208 @@
+package machinestats
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfluxSinkEncode(t *testing.T) {
+	require := require.New(t)
+
+	sink, err := NewInfluxSink(InfluxConfig{
+		URL:  "http://localhost:8086",
+		Tags: map[string]string{"host": "my host"},
+	})
+	require.Nil(err)
+
+	line, ok := sink.encode(&bandwidthMeasurement{1.5, "eth0", "download", 0}, 100)
+	require.True(ok)
+	require.Equal(`network.interfaces.download.mbps,host=my\ host,interface=eth0 value=1.5 100`, line)
+
+	line, ok = sink.encode(&BasicMeasurement{name: "app,version", measurementType: Gauge, value: `v"1"`}, 200)
+	require.True(ok)
+	require.Equal(`app\,version,host=my\ host value="v\"1\"" 200`, line)
+
+	_, ok = sink.encode(&BasicMeasurement{name: "nested", measurementType: Gauge, value: []interface{}{1}}, 300)
+	require.False(ok)
+}
+
+func TestInfluxSinkHTTP(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	nowFn = func() int64 { return 1000 }
+
+	mutex := sync.Mutex{}
+	attempts := 0
+	var body string
+	var query string
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		require.Equal("gzip", r.Header.Get("Content-Encoding"))
+		gz, err := gzip.NewReader(r.Body)
+		require.Nil(err)
+		b, err := io.ReadAll(gz)
+		require.Nil(err)
+		body = string(b)
+		query = r.URL.RawQuery
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(InfluxConfig{
+		URL:        server.URL + "/api/v2/write",
+		Org:        "org",
+		Bucket:     "bucket",
+		Token:      "secret",
+		Gzip:       true,
+		MaxRetries: 2,
+	})
+	require.Nil(err)
+
+	err = sink.Write([]Measurement{
+		&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.0},
+		&BasicMeasurement{name: "connections", measurementType: Gauge, value: 12},
+	})
+	require.Nil(err)
+	// The failed batch is sent again with the next flush instead of waiting
+	require.Error(sink.Flush())
+	require.Equal(1, attempts)
+	require.Nil(sink.Flush())
+
+	require.Equal(2, attempts)
+	require.Equal("memory-load value=50 1000\nconnections value=12 1000\n", body)
+	require.Equal("bucket=bucket&org=org&precision=ns", query)
+	require.Equal("Token secret", auth)
+	require.Nil(sink.Close())
+}
+
+func TestInfluxSinkHTTPError(t *testing.T) {
+	require := require.New(t)
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		require.Equal("/write", r.URL.Path)
+		require.Equal("stats", r.URL.Query().Get("db"))
+		http.Error(w, "bad line", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(InfluxConfig{
+		URL:        server.URL,
+		Database:   "stats",
+		MaxRetries: 3,
+	})
+	require.Nil(err)
+
+	require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "a", measurementType: Gauge, value: 1.0}}))
+	err = sink.Flush()
+	require.NotNil(err)
+	require.Contains(err.Error(), "bad line")
+	require.True(IsPermanent(err))
+	// Client errors are not retried
+	require.Equal(1, attempts)
+	// Failed lines are dropped
+	require.Nil(sink.Flush())
+	require.Equal(1, attempts)
+}
+
+func TestInfluxSinkRetries(t *testing.T) {
+	require := require.New(t)
+
+	mutex := sync.Mutex{}
+	bodies := make([]string, 0)
+	down := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(InfluxConfig{URL: server.URL, MaxRetries: 2})
+	require.Nil(err)
+	write := func(name string) {
+		require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: name, measurementType: Gauge, value: 1, timestamp: 1}}))
+	}
+
+	write("a")
+	require.Error(sink.Flush())
+	write("b")
+	// Once a batch fails the following ones are kept without being sent
+	require.Error(sink.Flush())
+	require.Equal([]string{"a value=1 1\n", "a value=1 1\n"}, bodies)
+
+	// a is dropped after its retries and b is tried next
+	bodies = bodies[:0]
+	require.Error(sink.Flush())
+	require.Error(sink.Flush())
+	require.Equal([]string{"a value=1 1\n", "b value=1 1\n"}, bodies)
+
+	// Retried batches go out in order once InfluxDB recovers
+	bodies = bodies[:0]
+	down = false
+	write("c")
+	require.Nil(sink.Flush())
+	require.Equal([]string{"b value=1 1\n", "c value=1 1\n"}, bodies)
+}
+
+func TestInfluxSinkUDP(t *testing.T) {
+	require := require.New(t)
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(err)
+	defer listener.Close()
+
+	sink, err := NewInfluxSink(InfluxConfig{
+		URL:        "udp://" + listener.LocalAddr().String(),
+		PacketSize: 40,
+	})
+	require.Nil(err)
+	defer sink.Close()
+
+	batch := []Measurement{
+		&BasicMeasurement{name: "first", measurementType: Gauge, value: 1.0},
+		&BasicMeasurement{name: "second", measurementType: Gauge, value: 2.0},
+		&BasicMeasurement{name: "third", measurementType: Gauge, value: 3.0},
+	}
+	require.Nil(sink.Write(batch))
+	require.Nil(sink.Flush())
+
+	lines := make([]string, 0)
+	buf := make([]byte, 1500)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lines) < len(batch) {
+		n, _, err := listener.ReadFrom(buf)
+		require.Nil(err)
+		require.True(n <= 40)
+		lines = append(lines, strings.Split(strings.TrimSpace(string(buf[:n])), "\n")...)
+	}
+	require.Equal(3, len(lines))
+	require.True(strings.HasPrefix(lines[0], "first value=1 "))
+	require.True(strings.HasPrefix(lines[2], "third value=3 "))
+}
@@ -7,8 +7,9 @@ import (
 
 // MemLoadStat represents all the information obtained from one /proc/meminfo read
 type MemLoadStat struct {
-	fs    *procfs.FS
-	value float64
+	fs        *procfs.FS
+	value     float64
+	timestamp int64
 }
 
 // NewMemLoadStat creates a new instance of MemLoadStat
@@ -19,7 +20,7 @@ func NewMemLoadStat(fs *procfs.FS) (*MemLoadStat, error) {
 	if fs == nil {
 		fs = procFS
 	}
-	return &MemLoadStat{fs, 0}, nil
+	return &MemLoadStat{fs, 0, 0}, nil
 }
 
 // Type of stat
@@ -32,6 +33,21 @@ func (m *MemLoadStat) Value() interface{} {
 	return m.value
 }
 
+// Timestamp at which the value was read
+func (m *MemLoadStat) Timestamp() int64 {
+	return m.timestamp
+}
+
+// Unit of stat
+func (m *MemLoadStat) Unit() Unit {
+	return UnitPercent
+}
+
+// Description of stat
+func (m *MemLoadStat) Description() string {
+	return "Percentage of memory in use"
+}
+
 // Name of stat
 func (m *MemLoadStat) Name() string {
 	return "memory-load"
@@ -43,6 +59,7 @@ func (m *MemLoadStat) Measure(channel chan<- Measurement) error {
 	if err != nil {
 		return err
 	}
+	m.timestamp = nowFn()
 
 	used := *meminfo.MemTotal - *meminfo.MemAvailable
 	pct := (float64(used) / float64(*meminfo.MemTotal)) * 100
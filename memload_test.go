@@ -101,4 +101,16 @@ func TestMemLoadStat(t *testing.T) {
 		memLoadStat.Measure(channel)
 		wg.Wait()
 	})
+
+	t.Run("Test timestamp", func(t *testing.T) {
+		oldNowFn := nowFn
+		defer func() { nowFn = oldNowFn }()
+		nowFn = func() int64 { return 1234 }
+
+		memLoadStat, err := NewMemLoadStat(&fs)
+		require.Nil(err)
+		channel := make(chan Measurement, 1)
+		require.Nil(memLoadStat.Measure(channel))
+		require.Equal(int64(1234), measurementTime(<-channel, 0))
+	})
 }
@@ -0,0 +1,104 @@
+package machinestats
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+)
+
+// metricFilter selects metrics by name. A name is selected if it matches any
+// of the glob patterns or regular expressions, or if there are none.
+type metricFilter struct {
+	patterns []string
+	regexps  []*regexp.Regexp
+}
+
+// newMetricFilter creates a filter from glob patterns as understood by
+// path.Match, such as cpu-load.* or exact names, and from regular expressions
+func newMetricFilter(patterns []string, expressions []string) (metricFilter, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return metricFilter{}, fmt.Errorf("invalid metric pattern %q: %w", pattern, err)
+		}
+	}
+	regexps := make([]*regexp.Regexp, len(expressions))
+	for idx, expression := range expressions {
+		re, err := regexp.Compile(expression)
+		if err != nil {
+			return metricFilter{}, fmt.Errorf("invalid metric regex %q: %w", expression, err)
+		}
+		regexps[idx] = re
+	}
+	return metricFilter{patterns, regexps}, nil
+}
+
+// metricFilterFromQuery creates a filter from the metric (glob) and regex
+// query parameters, both of which may be repeated
+func metricFilterFromQuery(query url.Values) (metricFilter, error) {
+	return newMetricFilter(query["metric"], query["regex"])
+}
+
+// Match returns whether the filter selects name
+func (f metricFilter) Match(name string) bool {
+	if len(f.patterns) == 0 && len(f.regexps) == 0 {
+		return true
+	}
+	for _, pattern := range f.patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	for _, re := range f.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredStat passes on only the measurements of a stat that a filter selects
+type filteredStat struct {
+	stat   ContextStat
+	filter metricFilter
+}
+
+// NewFilteredStat wraps stat so that only the measurements whose names match
+// any of the glob patterns or regular expressions are reported
+func NewFilteredStat(stat Stat, patterns []string, expressions []string) (Stat, error) {
+	filter, err := newMetricFilter(patterns, expressions)
+	if err != nil {
+		return nil, err
+	}
+	return &filteredStat{WithContext(stat), filter}, nil
+}
+
+// Name of the wrapped stat
+func (f *filteredStat) Name() string {
+	return f.stat.Name()
+}
+
+// Measure the wrapped stat
+func (f *filteredStat) Measure(channel chan<- Measurement) error {
+	return f.MeasureContext(context.Background(), channel)
+}
+
+// MeasureContext measures the wrapped stat, dropping the measurements that the
+// filter does not select
+func (f *filteredStat) MeasureContext(ctx context.Context, channel chan<- Measurement) error {
+	inner := make(chan Measurement)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range inner {
+			if f.filter.Match(m.Name()) {
+				channel <- m
+			}
+		}
+	}()
+	err := f.stat.MeasureContext(ctx, inner)
+	close(inner)
+	<-done
+	return err
+}
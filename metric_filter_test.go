@@ -0,0 +1,60 @@
+package machinestats
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricFilter(t *testing.T) {
+	require := require.New(t)
+
+	filter, err := metricFilterFromQuery(url.Values{})
+	require.Nil(err)
+	require.True(filter.Match("anything"))
+
+	filter, err = metricFilterFromQuery(url.Values{
+		"metric": {"cpu-load.*", "coturn.numSessions"},
+		"regex":  {"^memory\\.(used|free)$"},
+	})
+	require.Nil(err)
+	require.True(filter.Match("cpu-load.-1"))
+	require.True(filter.Match("coturn.numSessions"))
+	require.True(filter.Match("memory.used"))
+	require.False(filter.Match("coturn.latency"))
+	require.False(filter.Match("memory.used.total"))
+
+	_, err = newMetricFilter([]string{"["}, nil)
+	require.NotNil(err)
+	_, err = newMetricFilter(nil, []string{"("})
+	require.NotNil(err)
+}
+
+func TestFilteredStat(t *testing.T) {
+	require := require.New(t)
+
+	stat, err := NewFilteredStat(&fakeStat{name: "a", values: map[string]interface{}{
+		"a.kept":    1,
+		"a.dropped": 2,
+		"a.regex":   3,
+	}}, []string{"a.kept"}, []string{"regex$"})
+	require.Nil(err)
+	require.Equal("a", stat.Name())
+
+	measurements := measureAll(t, stat)
+	require.Len(measurements, 2)
+	require.Contains(measurements, "a.kept")
+	require.Contains(measurements, "a.regex")
+
+	// Errors are passed on along with whatever was measured
+	stat, err = NewFilteredStat(&fakeStat{name: "b", values: map[string]interface{}{"b.value": 1}, err: fmt.Errorf("boom")}, nil, nil)
+	require.Nil(err)
+	channel := make(chan Measurement, 10)
+	require.NotNil(stat.Measure(channel))
+	require.Len(channel, 1)
+
+	_, err = NewFilteredStat(&fakeStat{name: "c"}, nil, []string{"("})
+	require.NotNil(err)
+}
@@ -10,8 +10,9 @@ type NetStat struct {
 }
 
 type netStatMeasurement struct {
-	protocol string
-	value    int
+	protocol  string
+	value     int
+	timestamp int64
 }
 
 // NewNetStat returns a network statistics measurer
@@ -45,6 +46,21 @@ func (n *netStatMeasurement) Value() interface{} {
 	return n.value
 }
 
+// Unit of the stat
+func (n *netStatMeasurement) Unit() Unit {
+	return UnitNone
+}
+
+// Description of the stat
+func (n *netStatMeasurement) Description() string {
+	return "Sockets in use"
+}
+
+// Timestamp at which the sockets were counted
+func (n *netStatMeasurement) Timestamp() int64 {
+	return n.timestamp
+}
+
 // Measure returns the number of open sockets
 func (n *NetStat) Measure(channel chan<- Measurement) error {
 	sockstat, err := n.fs.NetSockstat()
@@ -55,6 +71,7 @@ func (n *NetStat) Measure(channel chan<- Measurement) error {
 	channel <- &netStatMeasurement{
 		"connections",
 		*sockstat.Used,
+		nowFn(),
 	}
 	return nil
 }
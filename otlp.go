@@ -0,0 +1,331 @@
+package machinestats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// OTLPEncodingProtobuf sends binary protobuf encoded requests
+	OTLPEncodingProtobuf = "protobuf"
+	// OTLPEncodingJSON sends JSON encoded requests
+	OTLPEncodingJSON = "json"
+
+	otlpScopeName         = "github.com/gurupras/go-machinestats"
+	defaultOTLPTimeout    = 10 * time.Second
+	otlpTemporalityDelta  = 1
+	otlpContentTypeProto  = "application/x-protobuf"
+	otlpContentTypeJSON   = "application/json"
+	otlpDefaultMetricsURL = "http://localhost:4318/v1/metrics"
+)
+
+// OTLPConfig configures an OTLPExporter
+type OTLPConfig struct {
+	// URL of the OTLP/HTTP metrics endpoint
+	URL string
+	// Encoding is either OTLPEncodingProtobuf or OTLPEncodingJSON
+	Encoding string
+	// Headers added to every request (e.g. authentication)
+	Headers map[string]string
+	// ResourceAttributes describe the entity producing the metrics, such as
+	// host.name and host.ip
+	ResourceAttributes map[string]string
+	// Timeout of each request
+	Timeout time.Duration
+}
+
+// OTLPExporter sends measurements to an OpenTelemetry collector over OTLP/HTTP.
+// Gauges are exported as OTLP gauges and counters as monotonic delta sums.
+// Timings, histograms and distributions are sent as gauges of each sample, and
+// sets are skipped.
+type OTLPExporter struct {
+	config  OTLPConfig
+	client  *http.Client
+	points  []otlpPoint
+	created int64
+	// seriesEnd maps each delta sum series to the time of its latest point,
+	// which is where the interval of its next point starts
+	seriesEnd map[string]int64
+}
+
+type otlpPoint struct {
+	family      string
+	statType    StatType
+	labels      map[string]string
+	value       float64
+	timestamp   int64
+	unit        Unit
+	description string
+}
+
+// NewOTLPExporter creates an OTLPExporter from the given config
+func NewOTLPExporter(config OTLPConfig) (*OTLPExporter, error) {
+	if config.URL == "" {
+		config.URL = otlpDefaultMetricsURL
+	}
+	switch config.Encoding {
+	case "":
+		config.Encoding = OTLPEncodingProtobuf
+	case OTLPEncodingProtobuf, OTLPEncodingJSON:
+	default:
+		return nil, fmt.Errorf("unsupported otlp encoding '%v'", config.Encoding)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultOTLPTimeout
+	}
+	return &OTLPExporter{
+		config:    config,
+		client:    &http.Client{Timeout: config.Timeout},
+		points:    make([]otlpPoint, 0),
+		created:   nowFn(),
+		seriesEnd: make(map[string]int64),
+	}, nil
+}
+
+// Write queues the measurements for the next export
+func (o *OTLPExporter) Write(measurements []Measurement) error {
+	now := nowFn()
+	for _, m := range measurements {
+		if m.Type() == Set {
+			// Counting unique members is left to backends that support sets
+			continue
+		}
+		value, ok := toFloat64(m.Value())
+		if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		p := otlpPoint{
+			family:    m.Name(),
+			statType:  m.Type(),
+			value:     value,
+			timestamp: measurementTime(m, now),
+		}
+		p.unit, p.description = measurementMetadata(m)
+		if lm, ok := m.(LabeledMeasurement); ok {
+			p.family = lm.Family()
+			p.labels = lm.Labels()
+		}
+		o.points = append(o.points, p)
+	}
+	return nil
+}
+
+// Flush exports all queued measurements in a single request. Measurements are
+// dropped if the request fails.
+func (o *OTLPExporter) Flush() error {
+	points := o.points
+	o.points = make([]otlpPoint, 0)
+	if len(points) == 0 {
+		return nil
+	}
+
+	request := o.buildRequest(points)
+	var body []byte
+	var contentType string
+	switch o.config.Encoding {
+	case OTLPEncodingJSON:
+		b, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = b
+		contentType = otlpContentTypeJSON
+	default:
+		body = request.marshalProto()
+		contentType = otlpContentTypeProto
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range o.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export %v otlp data points: %w", len(points), err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("failed to export %v otlp data points: unexpected status %v: %v", len(points), resp.Status, strings.TrimSpace(string(msg)))
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			return &PermanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// Close exports any queued measurements
+func (o *OTLPExporter) Close() error {
+	return o.Flush()
+}
+
+// buildRequest groups the points into one metric per family
+func (o *OTLPExporter) buildRequest(points []otlpPoint) *otlpExportRequest {
+	metrics := make([]*otlpMetric, 0)
+	byName := make(map[string]*otlpMetric)
+	for _, p := range points {
+		metric, ok := byName[p.family]
+		if !ok {
+			metric = &otlpMetric{
+				Name:        p.family,
+				Description: p.description,
+				Unit:        p.unit.ucum(),
+			}
+			switch p.statType {
+			case Counter:
+				metric.Sum = &otlpSum{
+					AggregationTemporality: otlpTemporalityDelta,
+					IsMonotonic:            true,
+				}
+			default:
+				metric.Gauge = &otlpGauge{}
+			}
+			byName[p.family] = metric
+			metrics = append(metrics, metric)
+		}
+		dp := otlpNumberDataPoint{
+			Attributes:   otlpAttributes(p.labels),
+			TimeUnixNano: uint64(p.timestamp),
+			AsDouble:     p.value,
+		}
+		if metric.Sum != nil {
+			dp.StartTimeUnixNano = uint64(o.startTime(p))
+			metric.Sum.DataPoints = append(metric.Sum.DataPoints, dp)
+		} else {
+			metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, dp)
+		}
+	}
+
+	return &otlpExportRequest{
+		ResourceMetrics: []otlpResourceMetrics{
+			{
+				Resource: otlpResource{
+					Attributes: otlpAttributes(o.config.ResourceAttributes),
+				},
+				ScopeMetrics: []otlpScopeMetrics{
+					{
+						Scope:   otlpScope{Name: otlpScopeName},
+						Metrics: metrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+// startTime returns the start of the interval that a delta sum point covers,
+// which is the time of the series' previous point. It is never later than the
+// point itself, which happens for points that are replayed from a spool.
+func (o *OTLPExporter) startTime(p otlpPoint) int64 {
+	key := otlpSeriesKey(p.family, p.labels)
+	start, ok := o.seriesEnd[key]
+	if !ok {
+		start = o.created
+	}
+	if start > p.timestamp {
+		start = p.timestamp
+	}
+	if p.timestamp > o.seriesEnd[key] {
+		o.seriesEnd[key] = p.timestamp
+	}
+	return start
+}
+
+// otlpSeriesKey identifies a series by its family and labels
+func otlpSeriesKey(family string, labels map[string]string) string {
+	key := strings.Builder{}
+	key.WriteString(family)
+	for _, kv := range otlpAttributes(labels) {
+		fmt.Fprintf(&key, "\x00%v=%v", kv.Key, kv.Value.StringValue)
+	}
+	return key.String()
+}
+
+func otlpAttributes(attributes map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpKeyValue, len(keys))
+	for idx, k := range keys {
+		kvs[idx] = otlpKeyValue{
+			Key:   k,
+			Value: otlpAnyValue{StringValue: attributes[k]},
+		}
+	}
+	return kvs
+}
+
+// The types below mirror the OTLP metrics protobuf messages. Their JSON tags
+// follow the OTLP/JSON mapping.
+
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	AsDouble          float64        `json:"asDouble"`
+}
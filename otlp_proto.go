@@ -0,0 +1,151 @@
+package machinestats
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Minimal protobuf encoding of the OTLP metrics messages. Field numbers are
+// taken from opentelemetry/proto/metrics/v1/metrics.proto and friends.
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+)
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return appendProtoVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, protoWireBytes)
+	b = appendProtoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(v))
+}
+
+func appendProtoUvarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoWireVarint)
+	return appendProtoVarint(b, v)
+}
+
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoWireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	b = appendProtoTag(b, field, protoWireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+func (r *otlpExportRequest) marshalProto() []byte {
+	b := make([]byte, 0, 1024)
+	for _, rm := range r.ResourceMetrics {
+		b = appendProtoBytes(b, 1, rm.marshalProto())
+	}
+	return b
+}
+
+func (rm *otlpResourceMetrics) marshalProto() []byte {
+	b := appendProtoBytes(nil, 1, rm.Resource.marshalProto())
+	for _, sm := range rm.ScopeMetrics {
+		b = appendProtoBytes(b, 2, sm.marshalProto())
+	}
+	return b
+}
+
+func (r *otlpResource) marshalProto() []byte {
+	var b []byte
+	for _, kv := range r.Attributes {
+		b = appendProtoBytes(b, 1, kv.marshalProto())
+	}
+	return b
+}
+
+func (sm *otlpScopeMetrics) marshalProto() []byte {
+	b := appendProtoBytes(nil, 1, sm.Scope.marshalProto())
+	for _, m := range sm.Metrics {
+		b = appendProtoBytes(b, 2, m.marshalProto())
+	}
+	return b
+}
+
+func (s *otlpScope) marshalProto() []byte {
+	b := appendProtoString(nil, 1, s.Name)
+	return appendProtoString(b, 2, s.Version)
+}
+
+func (kv *otlpKeyValue) marshalProto() []byte {
+	b := appendProtoString(nil, 1, kv.Key)
+	value := appendProtoBytes(nil, 1, []byte(kv.Value.StringValue))
+	return appendProtoBytes(b, 2, value)
+}
+
+func (m *otlpMetric) marshalProto() []byte {
+	b := appendProtoString(nil, 1, m.Name)
+	b = appendProtoString(b, 2, m.Description)
+	b = appendProtoString(b, 3, m.Unit)
+	if m.Gauge != nil {
+		b = appendProtoBytes(b, 5, m.Gauge.marshalProto())
+	}
+	if m.Sum != nil {
+		b = appendProtoBytes(b, 7, m.Sum.marshalProto())
+	}
+	return b
+}
+
+func (g *otlpGauge) marshalProto() []byte {
+	var b []byte
+	for _, dp := range g.DataPoints {
+		b = appendProtoBytes(b, 1, dp.marshalProto())
+	}
+	return b
+}
+
+func (s *otlpSum) marshalProto() []byte {
+	var b []byte
+	for _, dp := range s.DataPoints {
+		b = appendProtoBytes(b, 1, dp.marshalProto())
+	}
+	b = appendProtoUvarint(b, 2, uint64(s.AggregationTemporality))
+	if s.IsMonotonic {
+		b = appendProtoUvarint(b, 3, 1)
+	}
+	return b
+}
+
+func (dp *otlpNumberDataPoint) marshalProto() []byte {
+	b := appendProtoFixed64(nil, 2, dp.StartTimeUnixNano)
+	b = appendProtoFixed64(b, 3, dp.TimeUnixNano)
+	b = appendProtoDouble(b, 4, dp.AsDouble)
+	for _, kv := range dp.Attributes {
+		b = appendProtoBytes(b, 7, kv.marshalProto())
+	}
+	return b
+}
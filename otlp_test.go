@@ -0,0 +1,172 @@
+package machinestats
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPExporterJSON(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	nowFn = func() int64 { return 1000 }
+
+	var contentType, auth string
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		auth = r.Header.Get("Authorization")
+		require.Nil(json.NewDecoder(r.Body).Decode(&request))
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(OTLPConfig{
+		URL:      server.URL + "/v1/metrics",
+		Encoding: OTLPEncodingJSON,
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+		ResourceAttributes: map[string]string{
+			"host.name": "box",
+			"host.ip":   "10.0.0.1",
+		},
+	})
+	require.Nil(err)
+
+	nowFn = func() int64 { return 2000 }
+	require.Nil(exporter.Write([]Measurement{
+		&cpuBusyMeasurement{-1, 0.25, 0},
+		&cpuBusyMeasurement{0, 0.5, 0},
+		&BasicMeasurement{name: "requests", measurementType: Counter, value: 3},
+		&BasicMeasurement{name: "version", measurementType: Gauge, value: "v1"},
+	}))
+	require.Nil(exporter.Flush())
+	require.Equal("application/json", contentType)
+	require.Equal("Bearer secret", auth)
+
+	expected := `{
+		"resourceMetrics": [{
+			"resource": {"attributes": [
+				{"key": "host.ip", "value": {"stringValue": "10.0.0.1"}},
+				{"key": "host.name", "value": {"stringValue": "box"}}
+			]},
+			"scopeMetrics": [{
+				"scope": {"name": "github.com/gurupras/go-machinestats"},
+				"metrics": [
+					{"name": "cpu-load", "description": "Fraction of time the CPU was busy", "unit": "1", "gauge": {"dataPoints": [
+						{"attributes": [{"key": "cpu", "value": {"stringValue": "total"}}], "timeUnixNano": "2000", "asDouble": 0.25},
+						{"attributes": [{"key": "cpu", "value": {"stringValue": "00"}}], "timeUnixNano": "2000", "asDouble": 0.5}
+					]}},
+					{"name": "requests", "sum": {
+						"dataPoints": [{"startTimeUnixNano": "1000", "timeUnixNano": "2000", "asDouble": 3}],
+						"aggregationTemporality": 1,
+						"isMonotonic": true
+					}}
+				]
+			}]
+		}]
+	}`
+	actual, err := json.Marshal(request)
+	require.Nil(err)
+	require.JSONEq(expected, string(actual))
+
+	// Nothing is sent when there are no measurements
+	request = nil
+	require.Nil(exporter.Flush())
+	require.Nil(request)
+}
+
+func TestOTLPExporterProtobuf(t *testing.T) {
+	require := require.New(t)
+
+	var contentType string
+	var body []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(OTLPConfig{URL: server.URL})
+	require.Nil(err)
+
+	require.Nil(exporter.Write([]Measurement{&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.0}}))
+	require.Nil(exporter.Flush())
+	require.Equal("application/x-protobuf", contentType)
+	require.NotEmpty(body)
+	// ExportMetricsServiceRequest.resource_metrics
+	require.Equal(byte(0x0a), body[0])
+	require.Contains(string(body), "memory-load")
+
+	status = http.StatusBadRequest
+	require.Nil(exporter.Write([]Measurement{&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.0}}))
+	err = exporter.Flush()
+	require.NotNil(err)
+	require.True(IsPermanent(err))
+
+	// Servers that are overloaded are worth trying again
+	status = http.StatusTooManyRequests
+	require.Nil(exporter.Write([]Measurement{&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.0}}))
+	err = exporter.Flush()
+	require.NotNil(err)
+	require.False(IsPermanent(err))
+}
+
+func TestOTLPProtoEncoding(t *testing.T) {
+	require := require.New(t)
+
+	kv := otlpKeyValue{Key: "a", Value: otlpAnyValue{StringValue: "b"}}
+	require.Equal([]byte{0x0a, 0x01, 'a', 0x12, 0x03, 0x0a, 0x01, 'b'}, kv.marshalProto())
+
+	dp := otlpNumberDataPoint{TimeUnixNano: 1, AsDouble: 0.5}
+	require.Equal([]byte{
+		0x19, 0x01, 0, 0, 0, 0, 0, 0, 0,
+		0x21, 0, 0, 0, 0, 0, 0, 0xe0, 0x3f,
+	}, dp.marshalProto())
+
+	sum := otlpSum{AggregationTemporality: otlpTemporalityDelta, IsMonotonic: true}
+	require.Equal([]byte{0x10, 0x01, 0x18, 0x01}, sum.marshalProto())
+
+	require.Equal([]byte{0xac, 0x02}, appendProtoVarint(nil, 300))
+
+	_, err := NewOTLPExporter(OTLPConfig{Encoding: "xml"})
+	require.NotNil(err)
+}
+
+func TestOTLPExporterStartTimes(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	nowFn = func() int64 { return 1000 }
+
+	exporter, err := NewOTLPExporter(OTLPConfig{URL: "http://localhost:1/v1/metrics"})
+	require.Nil(err)
+
+	point := func(name string, timestamp int64) otlpPoint {
+		return otlpPoint{family: name, statType: Counter, value: 1, timestamp: timestamp}
+	}
+	starts := func(points ...otlpPoint) []uint64 {
+		request := exporter.buildRequest(points)
+		result := make([]uint64, 0)
+		for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			for _, dp := range metric.Sum.DataPoints {
+				result = append(result, dp.StartTimeUnixNano)
+			}
+		}
+		return result
+	}
+
+	// Each point starts where the previous point of its series ended
+	require.Equal([]uint64{1000, 2000, 1000}, starts(point("a", 2000), point("a", 3000), point("b", 3000)))
+	require.Equal([]uint64{3000}, starts(point("a", 4000)))
+	// Replayed points never start after they end
+	require.Equal([]uint64{1500}, starts(point("a", 1500)))
+	require.Equal([]uint64{4000}, starts(point("a", 5000)))
+}
@@ -0,0 +1,234 @@
+package machinestats
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrometheusExporter keeps the latest value of every measurement it is given
+// and renders them in the Prometheus text exposition format. Counters, which
+// measurements report as increments, are added up so that they only increase.
+// Timings, histograms and distributions show their latest sample as a gauge;
+// sets are not exported.
+type PrometheusExporter struct {
+	namespace string
+	expiry    time.Duration
+	mutex     sync.Mutex
+	entries   map[string]*prometheusEntry
+}
+
+// prometheusEntry is a copy of what is exported of a measurement, since
+// stats may reuse their measurements for the next cycle
+type prometheusEntry struct {
+	family      string
+	labels      string
+	typ         StatType
+	value       float64
+	unit        Unit
+	description string
+	updated     int64
+}
+
+type prometheusSample struct {
+	labels string
+	value  float64
+}
+
+type prometheusFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []prometheusSample
+}
+
+// NewPrometheusExporter creates a PrometheusExporter. Metric names are prefixed
+// with namespace when it is not empty. Measurements that have not been updated
+// within expiry are no longer exported; an expiry of 0 keeps them forever.
+func NewPrometheusExporter(namespace string, expiry time.Duration) *PrometheusExporter {
+	return &PrometheusExporter{
+		namespace: namespace,
+		expiry:    expiry,
+		entries:   make(map[string]*prometheusEntry),
+	}
+}
+
+// Record stores the given measurements, replacing any previous measurement
+// with the same name. Counters are added to the previous value instead.
+func (p *PrometheusExporter) Record(measurements ...Measurement) {
+	now := nowFn()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, m := range measurements {
+		if m.Type() == Set {
+			// Counting unique members is left to backends that support sets
+			continue
+		}
+		value, ok := toFloat64(m.Value())
+		if !ok {
+			continue
+		}
+		entry := &prometheusEntry{
+			family:  m.Name(),
+			typ:     m.Type(),
+			value:   value,
+			updated: now,
+		}
+		if lm, ok := m.(LabeledMeasurement); ok {
+			entry.family = lm.Family()
+			entry.labels = formatPrometheusLabels(lm.Labels())
+		}
+		entry.unit, entry.description = measurementMetadata(m)
+		if previous, ok := p.entries[m.Name()]; ok && entry.typ == Counter && previous.typ == Counter {
+			entry.value += previous.value
+		}
+		p.entries[m.Name()] = entry
+	}
+}
+
+// Write records the measurements so that they are served on the next scrape
+func (p *PrometheusExporter) Write(measurements []Measurement) error {
+	p.Record(measurements...)
+	return nil
+}
+
+// Flush is a no-op since measurements are pulled by the scraper
+func (p *PrometheusExporter) Flush() error {
+	return nil
+}
+
+// Close is a no-op
+func (p *PrometheusExporter) Close() error {
+	return nil
+}
+
+// ServeHTTP renders all current measurements
+func (p *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(p.render())
+}
+
+func (p *PrometheusExporter) render() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := nowFn()
+	families := make(map[string]*prometheusFamily)
+	for name, entry := range p.entries {
+		if p.expiry > 0 && time.Duration(now-entry.updated) > p.expiry {
+			delete(p.entries, name)
+			continue
+		}
+		metricName, typ := p.metricName(entry.family, entry.typ, entry.unit)
+		f, ok := families[metricName]
+		if !ok {
+			description := entry.description
+			if description == "" {
+				description = fmt.Sprintf("machinestats metric %v", entry.family)
+			}
+			f = &prometheusFamily{
+				name: metricName,
+				help: description,
+				typ:  typ,
+			}
+			families[metricName] = f
+		}
+		f.samples = append(f.samples, prometheusSample{entry.labels, entry.value})
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.Buffer{}
+	for _, name := range names {
+		f := families[name]
+		sort.Slice(f.samples, func(i, j int) bool {
+			return f.samples[i].labels < f.samples[j].labels
+		})
+		fmt.Fprintf(&buf, "# HELP %v %v\n", f.name, escapePrometheusHelp(f.help))
+		fmt.Fprintf(&buf, "# TYPE %v %v\n", f.name, f.typ)
+		for _, sample := range f.samples {
+			fmt.Fprintf(&buf, "%v%v %v\n", f.name, sample.labels, formatPrometheusValue(sample.value))
+		}
+	}
+	return buf.Bytes()
+}
+
+// metricName returns the Prometheus name and type of a family. Following the
+// Prometheus naming conventions, the name ends with the unit and counters with
+// _total.
+func (p *PrometheusExporter) metricName(family string, statType StatType, unit Unit) (string, string) {
+	name := sanitizePrometheusName(family)
+	if p.namespace != "" {
+		name = fmt.Sprintf("%v_%v", sanitizePrometheusName(p.namespace), name)
+	}
+	if suffix := unit.prometheusSuffix(); suffix != "" {
+		suffix = "_" + sanitizePrometheusName(suffix)
+		if !strings.HasSuffix(strings.TrimSuffix(name, "_total"), suffix) {
+			name += suffix
+		}
+	}
+	switch statType {
+	case Counter:
+		if !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+		return name, "counter"
+	default:
+		return name, "gauge"
+	}
+}
+
+// sanitizePrometheusName replaces every character that is not allowed in a
+// Prometheus metric or label name with an underscore
+func sanitizePrometheusName(name string) string {
+	b := []byte(name)
+	for idx, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && idx > 0:
+		default:
+			b[idx] = '_'
+		}
+	}
+	return string(b)
+}
+
+func formatPrometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for idx, k := range keys {
+		pairs[idx] = fmt.Sprintf("%v=\"%v\"", sanitizePrometheusName(k), escapePrometheusLabelValue(labels[k]))
+	}
+	return fmt.Sprintf("{%v}", strings.Join(pairs, ","))
+}
+
+var prometheusHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapePrometheusHelp(help string) string {
+	return prometheusHelpEscaper.Replace(help)
+}
+
+func escapePrometheusLabelValue(value string) string {
+	return prometheusLabelEscaper.Replace(value)
+}
+
+func formatPrometheusValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,100 @@
+package machinestats
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+	require := require.New(t)
+
+	exporter := NewPrometheusExporter("machinestats", 0)
+	exporter.Record(
+		&cpuBusyMeasurement{-1, 0.25, 0},
+		&cpuBusyMeasurement{0, 0.5, 0},
+		&bandwidthMeasurement{1.5, "eth0", "download", 0},
+		&BasicMeasurement{name: "requests", measurementType: Counter, value: uint64(42)},
+		&BasicMeasurement{name: "app.version", measurementType: Gauge, value: "v1"},
+		&BasicMeasurement{name: "sent", measurementType: Counter, value: 7, unit: UnitBytes, description: "Bytes sent"},
+		&BasicMeasurement{name: "latency", measurementType: Timing, value: 12, unit: UnitMilliseconds},
+		&BasicMeasurement{name: "users", measurementType: Set, value: 42},
+	)
+
+	server := httptest.NewServer(exporter)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	require.Nil(err)
+	defer resp.Body.Close()
+	require.Contains(resp.Header.Get("Content-Type"), "text/plain")
+
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(err)
+
+	expected := strings.TrimLeft(`
+# HELP machinestats_cpu_load_ratio Fraction of time the CPU was busy
+# TYPE machinestats_cpu_load_ratio gauge
+machinestats_cpu_load_ratio{cpu="00"} 0.5
+machinestats_cpu_load_ratio{cpu="total"} 0.25
+# HELP machinestats_latency_milliseconds machinestats metric latency
+# TYPE machinestats_latency_milliseconds gauge
+machinestats_latency_milliseconds 12
+# HELP machinestats_network_interfaces_download_mbps Network download rate
+# TYPE machinestats_network_interfaces_download_mbps gauge
+machinestats_network_interfaces_download_mbps{interface="eth0"} 1.5
+# HELP machinestats_requests_total machinestats metric requests
+# TYPE machinestats_requests_total counter
+machinestats_requests_total 42
+# HELP machinestats_sent_bytes_total Bytes sent
+# TYPE machinestats_sent_bytes_total counter
+machinestats_sent_bytes_total 7
+`, "\n")
+	require.Equal(expected, string(body))
+}
+
+func TestPrometheusExporterExpiry(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+
+	now := time.Now().UnixNano()
+	nowFn = func() int64 { return now }
+
+	exporter := NewPrometheusExporter("", 5*time.Second)
+	exporter.Record(&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.0})
+	require.Contains(string(exporter.render()), "memory_load 50\n")
+
+	nowFn = func() int64 { return now + int64(10*time.Second) }
+	require.Empty(string(exporter.render()))
+}
+
+func TestSanitizePrometheusName(t *testing.T) {
+	require := require.New(t)
+	require.Equal("cpu_load", sanitizePrometheusName("cpu-load"))
+	require.Equal("coturn_numSessions", sanitizePrometheusName("coturn.numSessions"))
+	require.Equal("_abc", sanitizePrometheusName("0abc"))
+	require.Equal(`a\"b\\c\nd`, escapePrometheusLabelValue("a\"b\\c\nd"))
+}
+
+func TestPrometheusExporterCounters(t *testing.T) {
+	require := require.New(t)
+
+	exporter := NewPrometheusExporter("", 0)
+	for i := 0; i < 5; i++ {
+		exporter.Record(&BasicMeasurement{name: "errors.bad", measurementType: Counter, value: 1})
+	}
+	require.Contains(string(exporter.render()), "errors_bad_total 5\n")
+
+	// Gauges keep the latest value, as it was when it was recorded
+	exporter.Record(&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.0})
+	m := &BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 40.0}
+	exporter.Record(m)
+	m.value = 70.0
+	require.Contains(string(exporter.render()), "memory_load 40\n")
+}
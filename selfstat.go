@@ -0,0 +1,150 @@
+package machinestats
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/procfs"
+	log "github.com/sirupsen/logrus"
+)
+
+// SelfStat reports the health of machinestatsd itself so that an idle host
+// can be told apart from a broken agent
+type SelfStat struct {
+	collector      *Collector
+	fs             *procfs.FS
+	prevCPUTime    float64
+	prevTime       time.Time
+	lastSinkErrors uint64
+	lastNumGC      uint32
+}
+
+// NewSelfStat creates a SelfStat that reports on collector and on the current
+// process
+func NewSelfStat(fs *procfs.FS, collector *Collector) (*SelfStat, error) {
+	if err := setupProcFS(); err != nil {
+		return nil, err
+	}
+	if fs == nil {
+		fs = procFS
+	}
+	return &SelfStat{
+		collector: collector,
+		fs:        fs,
+	}, nil
+}
+
+// statHealthMeasurement is a measurement about a single stat
+type statHealthMeasurement struct {
+	stat      string
+	metric    string
+	value     interface{}
+	timestamp int64
+}
+
+// Name of the measurement
+func (s *statHealthMeasurement) Name() string {
+	return fmt.Sprintf("machinestatsd.stats.%v.%v", s.stat, s.metric)
+}
+
+// Type of stat
+func (s *statHealthMeasurement) Type() StatType {
+	return Gauge
+}
+
+func (s *statHealthMeasurement) Value() interface{} {
+	return s.value
+}
+
+// Timestamp at which the health was read
+func (s *statHealthMeasurement) Timestamp() int64 {
+	return s.timestamp
+}
+
+// Unit of the measurement
+func (s *statHealthMeasurement) Unit() Unit {
+	if s.metric == "duration" {
+		return UnitSeconds
+	}
+	return UnitNone
+}
+
+// Description of the measurement
+func (s *statHealthMeasurement) Description() string {
+	if s.metric == "duration" {
+		return "Time taken by the last measurement of the stat"
+	}
+	return "Measurements produced by the last measurement of the stat"
+}
+
+// Family of the measurement
+func (s *statHealthMeasurement) Family() string {
+	return fmt.Sprintf("machinestatsd.stats.%v", s.metric)
+}
+
+// Labels of the measurement
+func (s *statHealthMeasurement) Labels() map[string]string {
+	return map[string]string{"stat": s.stat}
+}
+
+// Name of this stat
+func (s *SelfStat) Name() string {
+	return "machinestatsd"
+}
+
+// Measure the collector's and the process' health. Failures of the stats
+// themselves are already counted by the collector as machinestatsd.errors.
+func (s *SelfStat) Measure(channel chan<- Measurement) error {
+	now := nowFn()
+	health := s.collector.Health()
+	for name, stat := range health.Stats {
+		channel <- &statHealthMeasurement{name, "duration", stat.Duration.Seconds(), now}
+		channel <- &statHealthMeasurement{name, "measurements", stat.Measurements, now}
+	}
+	sinkErrors := health.SinkErrors - s.lastSinkErrors
+	s.lastSinkErrors = health.SinkErrors
+	channel <- &BasicMeasurement{"machinestatsd.sink.errors", Counter, sinkErrors, now, UnitNone, "Failed sink writes and flushes"}
+	channel <- &BasicMeasurement{"machinestatsd.collector.backlog", Gauge, health.Backlog, now, UnitNone, "Stats that waited for a free worker in the last cycle"}
+	channel <- &BasicMeasurement{"machinestatsd.collector.abandoned", Gauge, atomic.LoadInt64(&abandonedMeasurements), now, UnitNone, "Timed out measurements that are still running"}
+
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+	numGC := memStats.NumGC - s.lastNumGC
+	s.lastNumGC = memStats.NumGC
+	channel <- &BasicMeasurement{"machinestatsd.runtime.goroutines", Gauge, runtime.NumGoroutine(), now, UnitNone, "Goroutines in machinestatsd"}
+	channel <- &BasicMeasurement{"machinestatsd.runtime.heap-alloc", Gauge, memStats.HeapAlloc, now, UnitBytes, "Heap memory allocated by machinestatsd"}
+	channel <- &BasicMeasurement{"machinestatsd.runtime.sys", Gauge, memStats.Sys, now, UnitBytes, "Memory obtained from the OS by the Go runtime"}
+	channel <- &BasicMeasurement{"machinestatsd.runtime.gc", Counter, numGC, now, UnitNone, "Completed garbage collection cycles"}
+
+	proc, err := s.fs.Self()
+	if err == nil {
+		var stat procfs.ProcStat
+		stat, err = proc.Stat()
+		if err == nil {
+			s.measureProcess(channel, stat, now)
+		}
+	}
+	if err != nil {
+		// The collector's health is more important than the process stats
+		log.Debugf("Failed to read process stats: %v\n", err)
+	}
+	return nil
+}
+
+// measureProcess reports the process' memory and the fraction of a CPU it used
+// since the previous measurement
+func (s *SelfStat) measureProcess(channel chan<- Measurement, stat procfs.ProcStat, timestamp int64) {
+	now := time.Now()
+	cpuTime := stat.CPUTime()
+	if !s.prevTime.IsZero() {
+		elapsed := now.Sub(s.prevTime).Seconds()
+		if elapsed > 0 {
+			channel <- &BasicMeasurement{"machinestatsd.process.cpu", Gauge, (cpuTime - s.prevCPUTime) / elapsed, timestamp, UnitRatio, "CPU time used by machinestatsd per second"}
+		}
+	}
+	s.prevCPUTime = cpuTime
+	s.prevTime = now
+	channel <- &BasicMeasurement{"machinestatsd.process.rss", Gauge, stat.ResidentMemory(), timestamp, UnitBytes, "Resident memory of machinestatsd"}
+}
@@ -0,0 +1,64 @@
+package machinestats
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/require"
+)
+
+func measureAll(t *testing.T, stat Stat) map[string]Measurement {
+	batch, err := measure(context.Background(), WithContext(stat), time.Second)
+	require.Nil(t, err)
+	result := make(map[string]Measurement)
+	for _, m := range batch {
+		result[m.Name()] = m
+	}
+	return result
+}
+
+func TestSelfStat(t *testing.T) {
+	require := require.New(t)
+
+	failing := &mockSink{writeErr: fmt.Errorf("boom")}
+	collector := NewCollector(time.Second, NewMultiSink(failing, &mockSink{}))
+	collector.SetWorkers(1)
+	collector.Register(
+		&fakeStat{name: "a", values: map[string]interface{}{"a.1": 1, "a.2": 2}},
+		&fakeStat{name: "broken", err: fmt.Errorf("boom")},
+	)
+	collector.Collect()
+
+	fs, err := procfs.NewFS("/proc")
+	require.Nil(err)
+	stat, err := NewSelfStat(&fs, collector)
+	require.Nil(err)
+
+	measurements := measureAll(t, stat)
+	require.Equal(2, measurements["machinestatsd.stats.a.measurements"].Value())
+	require.Contains(measurements, "machinestatsd.stats.broken.duration")
+	duration := measurements["machinestatsd.stats.a.duration"].(LabeledMeasurement)
+	require.Equal("machinestatsd.stats.duration", duration.Family())
+	require.Equal(map[string]string{"stat": "a"}, duration.Labels())
+
+	// Both stats failed to be written to one sink
+	require.Equal(uint64(2), measurements["machinestatsd.sink.errors"].Value())
+	require.Equal(Counter, measurements["machinestatsd.sink.errors"].Type())
+	require.Equal(1, measurements["machinestatsd.collector.backlog"].Value())
+	require.NotZero(measurements["machinestatsd.runtime.goroutines"].Value())
+	require.NotZero(measurements["machinestatsd.runtime.heap-alloc"].Value())
+	require.NotZero(measurements["machinestatsd.process.rss"].Value())
+	// CPU usage is only known from the second measurement onwards
+	require.NotContains(measurements, "machinestatsd.process.cpu")
+
+	measurements = measureAll(t, stat)
+	require.Equal(uint64(0), measurements["machinestatsd.sink.errors"].Value())
+	require.Contains(measurements, "machinestatsd.process.cpu")
+
+	health := collector.Health()
+	require.Equal(uint64(1), health.Stats["broken"].Errors)
+	require.Equal(uint64(0), health.Stats["a"].Errors)
+}
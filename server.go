@@ -2,29 +2,78 @@ package machinestats
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// certificateCheckInterval is how often the certificate files are checked for
+// changes
+const certificateCheckInterval = 5 * time.Second
+
+// HTTPServerConfig configures the server started by StartHTTPServerWithConfig
+type HTTPServerConfig struct {
+	// Address to bind to. Empty binds to every address.
+	Address string
+	Port    int
+	// TLSCertFile and TLSKeyFile enable HTTPS. The files are reloaded when they
+	// change, so certificates can be renewed without a restart.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ClientCAFile enables mutual TLS. Clients must present a certificate
+	// signed by one of the CAs in the file.
+	ClientCAFile string
+	// BearerTokens and BasicAuth (user to password) enable authentication. A
+	// request is allowed if it carries any of the tokens or credentials.
+	BearerTokens []string
+	BasicAuth    map[string]string
+	// PublicPaths are served without authentication, e.g. for health checks
+	PublicPaths []string
+}
+
 // StartHTTPServer starts an HTTP server on the specified port and returns a stop function.
 func StartHTTPServer(ip string, port int) (mux *http.ServeMux, stop func() error, err error) {
+	return StartHTTPServerWithConfig(HTTPServerConfig{
+		Address: ip,
+		Port:    port,
+	})
+}
+
+// StartHTTPServerWithConfig starts an HTTP(S) server as configured and returns
+// the mux it serves along with a stop function
+func StartHTTPServerWithConfig(config HTTPServerConfig) (mux *http.ServeMux, stop func() error, err error) {
 	mux = http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "OK")
 	})
 
+	var tlsConfig *tls.Config
+	tlsConfig, err = serverTLSConfig(config)
+	if err != nil {
+		return
+	}
+
 	server := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", ip, port),
-		Handler: mux,
+		Addr:      fmt.Sprintf("%s:%d", config.Address, config.Port),
+		Handler:   withAuth(config, mux),
+		TLSConfig: tlsConfig,
 	}
 
 	// Create a listener
 	var listener net.Listener
 	listener, err = net.Listen("tcp", server.Addr)
 	if err != nil {
-		err = fmt.Errorf("failed to listen on port %d: %w", port, err)
+		err = fmt.Errorf("failed to listen on port %d: %w", config.Port, err)
 		return
 	}
 
@@ -34,7 +83,14 @@ func StartHTTPServer(ip string, port int) (mux *http.ServeMux, stop func() error
 	// Start the server in a new goroutine
 	go func() {
 		defer close(stopChan)
-		if err := server.Serve(listener); err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			// The certificate comes from tlsConfig.GetCertificate
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
 			fmt.Printf("HTTP server ListenAndServe: %v\n", err)
 		}
 	}()
@@ -49,3 +105,157 @@ func StartHTTPServer(ip string, port int) (mux *http.ServeMux, stop func() error
 	}
 	return
 }
+
+// serverTLSConfig returns the TLS configuration of the server, or nil if TLS
+// is not enabled
+func serverTLSConfig(config HTTPServerConfig) (*tls.Config, error) {
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		if config.ClientCAFile != "" {
+			return nil, fmt.Errorf("client certificate verification requires a TLS certificate and key")
+		}
+		return nil, nil
+	}
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return nil, fmt.Errorf("both a TLS certificate and key are required")
+	}
+	reloader, err := newCertificateReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %v", config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// certificateReloader serves a certificate and key pair from files, loading
+// them again whenever either file changes
+type certificateReloader struct {
+	certFile  string
+	keyFile   string
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the certificate and key if they changed since they were last
+// read
+func (r *certificateReloader) load() error {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate. Failures to reload it are
+// logged and the previous certificate is kept, since the files may be in the
+// middle of being replaced.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.lastCheck) >= certificateCheckInterval {
+		r.lastCheck = time.Now()
+		if err := r.load(); err != nil {
+			log.Errorf("Failed to reload TLS certificate: %v\n", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// latestModTime returns the most recent modification time of the files
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// withAuth wraps handler so that requests to anything but the public paths
+// must be authenticated, if any credentials are configured
+func withAuth(config HTTPServerConfig, handler http.Handler) http.Handler {
+	if len(config.BearerTokens) == 0 && len(config.BasicAuth) == 0 {
+		return handler
+	}
+	public := make(map[string]bool, len(config.PublicPaths))
+	for _, path := range config.PublicPaths {
+		public[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if public[r.URL.Path] || authorized(config, r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if len(config.BasicAuth) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="machinestatsd"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="machinestatsd"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// authorized returns whether the request carries a valid bearer token or basic
+// auth credentials
+func authorized(config HTTPServerConfig, r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimPrefix(header, "Bearer ")
+		for _, expected := range config.BearerTokens {
+			if expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	expected, exists := config.BasicAuth[user]
+	if !exists {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
@@ -1,10 +1,23 @@
 package machinestats
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -49,3 +62,142 @@ func TestStartHTTPServer_PortInUse(t *testing.T) {
 	_, _, err = StartHTTPServer("", port)
 	assert.Error(t, err, "Expected an error when starting a second server on the same port")
 }
+
+// writeCertificate creates a certificate for localhost signed by parent, or a
+// self-signed CA if parent is nil, and writes it and its key as PEM to dir
+func writeCertificate(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func TestStartHTTPServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCertificate(t, dir, "ca", nil, nil)
+	writeCertificate(t, dir, "server", ca, caKey)
+	writeCertificate(t, dir, "client", ca, caKey)
+
+	port := 8083
+	_, stop, err := StartHTTPServerWithConfig(HTTPServerConfig{
+		Address:      "127.0.0.1",
+		Port:         port,
+		TLSCertFile:  filepath.Join(dir, "server.crt"),
+		TLSKeyFile:   filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	})
+	require.NoError(t, err)
+	defer stop()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	url := fmt.Sprintf("https://localhost:%d/", port)
+
+	// Clients without a certificate are rejected
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, err = client.Get(url)
+	assert.Error(t, err)
+
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	require.NoError(t, err)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}}}
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// A key without a certificate is a configuration error
+	_, _, err = StartHTTPServerWithConfig(HTTPServerConfig{Port: 8084, TLSKeyFile: filepath.Join(dir, "server.key")})
+	assert.Error(t, err)
+	_, _, err = StartHTTPServerWithConfig(HTTPServerConfig{Port: 8084, ClientCAFile: filepath.Join(dir, "ca.crt")})
+	assert.Error(t, err)
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCertificate(t, dir, "ca", nil, nil)
+	first, _ := writeCertificate(t, dir, "server", ca, caKey)
+	reloader, err := newCertificateReloader(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	require.NoError(t, err)
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Raw, cert.Certificate[0])
+
+	second, _ := writeCertificate(t, dir, "server", ca, caKey)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "server.crt"), later, later))
+	reloader.lastCheck = time.Time{}
+	cert, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.Raw, cert.Certificate[0])
+
+	// Broken files keep the previous certificate
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "server.crt"), []byte("broken"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "server.crt"), later, later))
+	reloader.lastCheck = time.Time{}
+	cert, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.Raw, cert.Certificate[0])
+}
+
+func TestStartHTTPServerAuth(t *testing.T) {
+	port := 8085
+	mux, stop, err := StartHTTPServerWithConfig(HTTPServerConfig{
+		Port:         port,
+		BearerTokens: []string{"secret"},
+		BasicAuth:    map[string]string{"admin": "password"},
+		PublicPaths:  []string{"/healthz"},
+	})
+	require.NoError(t, err)
+	defer stop()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+
+	get := func(path string, setAuth func(r *http.Request)) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%v", port, path), nil)
+		require.NoError(t, err)
+		setAuth(req)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/", func(r *http.Request) {})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Equal(t, `Basic realm="machinestatsd"`, resp.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, 401, get("/", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }).StatusCode)
+	assert.Equal(t, 401, get("/", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }).StatusCode)
+	assert.Equal(t, 200, get("/", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }).StatusCode)
+	assert.Equal(t, 200, get("/", func(r *http.Request) { r.SetBasicAuth("admin", "password") }).StatusCode)
+	assert.Equal(t, 200, get("/healthz", func(r *http.Request) {}).StatusCode)
+}
@@ -0,0 +1,120 @@
+package machinestats
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Sink is a destination for measurements
+type Sink interface {
+	// Write queues a batch of measurements for delivery
+	Write(measurements []Measurement) error
+	// Flush delivers everything written since the previous Flush
+	Flush() error
+	// Close flushes any pending measurements and releases the sink's resources
+	Close() error
+}
+
+// MultiSink fans out measurements to several sinks
+type MultiSink struct {
+	sinks []Sink
+}
+
+// NewMultiSink creates a MultiSink that writes to all of the given sinks
+func NewMultiSink(sinks ...Sink) *MultiSink {
+	return &MultiSink{sinks}
+}
+
+// Write the measurements to every sink
+func (m *MultiSink) Write(measurements []Measurement) error {
+	return m.each(func(s Sink) error {
+		return s.Write(measurements)
+	})
+}
+
+// Flush every sink
+func (m *MultiSink) Flush() error {
+	return m.each(func(s Sink) error {
+		return s.Flush()
+	})
+}
+
+// Close every sink
+func (m *MultiSink) Close() error {
+	return m.each(func(s Sink) error {
+		return s.Close()
+	})
+}
+
+// each calls fn on every sink, even if some of them fail
+func (m *MultiSink) each(fn func(Sink) error) error {
+	var errs multiError
+	for _, s := range m.sinks {
+		if err := fn(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for idx, err := range m {
+		msgs[idx] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// PermanentError is returned by a sink whose backend rejected a batch, which
+// sending the batch again would not change
+type PermanentError struct {
+	Err error
+}
+
+func (p *PermanentError) Error() string {
+	return p.Err.Error()
+}
+
+func (p *PermanentError) Unwrap() error {
+	return p.Err
+}
+
+// IsPermanent returns whether err means that a batch was rejected for good
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// LogSink logs every measurement at debug level instead of sending it anywhere
+type LogSink struct{}
+
+// NewLogSink creates a LogSink
+func NewLogSink() *LogSink {
+	return &LogSink{}
+}
+
+// Write logs the measurements
+func (l *LogSink) Write(measurements []Measurement) error {
+	for _, m := range measurements {
+		value, _ := toFloat64(m.Value())
+		log.Debugf("Logged stat '%v' (%0.2f)\n", m.Name(), value)
+	}
+	return nil
+}
+
+// Flush is a no-op
+func (l *LogSink) Flush() error {
+	return nil
+}
+
+// Close is a no-op
+func (l *LogSink) Close() error {
+	return nil
+}
@@ -0,0 +1,61 @@
+package machinestats
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mockSink struct {
+	written  []Measurement
+	flushes  int
+	closed   bool
+	writeErr error
+}
+
+func (m *mockSink) Write(measurements []Measurement) error {
+	if m.writeErr != nil {
+		return m.writeErr
+	}
+	m.written = append(m.written, measurements...)
+	return nil
+}
+
+func (m *mockSink) Flush() error {
+	m.flushes++
+	return nil
+}
+
+func (m *mockSink) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestMultiSink(t *testing.T) {
+	require := require.New(t)
+
+	failing := &mockSink{writeErr: fmt.Errorf("boom")}
+	first := &mockSink{}
+	second := &mockSink{}
+	sink := NewMultiSink(first, failing, second)
+
+	batch := []Measurement{
+		&BasicMeasurement{name: "a", measurementType: Gauge, value: 1.0},
+		&BasicMeasurement{name: "b", measurementType: Counter, value: 2},
+	}
+	err := sink.Write(batch)
+	require.NotNil(err)
+	require.Contains(err.Error(), "boom")
+	require.Equal(batch, first.written)
+	require.Equal(batch, second.written)
+
+	require.Nil(sink.Flush())
+	require.Equal(1, first.flushes)
+	require.Equal(1, second.flushes)
+
+	require.Nil(sink.Close())
+	require.True(first.closed)
+	require.True(failing.closed)
+	require.True(second.closed)
+}
@@ -0,0 +1,583 @@
+package machinestats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSpoolMaxBytes    = 64 * 1024 * 1024
+	defaultSpoolReplayLimit = 100
+	// spoolSegments is the number of files that a full spool is split into
+	spoolSegments = 8
+)
+
+// SpoolConfig configures a SpoolSink
+type SpoolConfig struct {
+	// Name identifies the spool. It is used for the spool's file names and in
+	// the spool's own metrics.
+	Name string
+	// Dir is the directory the spool files are kept in
+	Dir string
+	// MaxBytes bounds the size of the spooled batches. The oldest batches are
+	// dropped once it is exceeded.
+	MaxBytes int64
+	// ReplayLimit is the maximum number of spooled batches replayed per Flush
+	ReplayLimit int
+}
+
+// SpoolSink wraps a network sink and keeps every batch that it fails to
+// deliver in an on-disk spool. The spool is a sequence of append-only segment
+// files, which are deleted once every batch in them has been replayed or
+// dropped, along with an index in memory, so that a Flush only reads the
+// batches that it replays. Spooled batches are replayed in order, with
+// their original timestamps, once the sink recovers. New batches are spooled
+// behind older ones until the spool has drained so that ordering is kept.
+// Spooling counts as success, so Flush does not fail while the spool covers an
+// outage; its size is reported by the spool's own stats instead.
+//
+// The wrapped sink must drop whatever it was unable to deliver when Flush
+// returns an error, otherwise measurements are delivered twice. Batches that
+// it rejects with a PermanentError are dropped instead of being spooled, since
+// they would otherwise hold up every batch behind them.
+//
+// SpoolSink is also a Stat reporting the size of the spool and the number of
+// measurements that were dropped because it was full or rejected.
+type SpoolSink struct {
+	config  SpoolConfig
+	inner   Sink
+	mutex   sync.Mutex
+	pending []Measurement
+	// written is the time at which each pending measurement was written, which
+	// is what it is spooled with if it has no timestamp of its own
+	written []int64
+	// batches are the spooled batches, oldest first
+	batches []spoolBatch
+	// first and last are the oldest and newest segment files, and lastSize is
+	// the size of the newest one
+	first       int64
+	last        int64
+	lastSize    int64
+	size        int64
+	entries     int
+	dropped     uint64
+	lastDropped uint64
+	// rejected counts the measurements that the wrapped sink rejected
+	rejected     uint64
+	lastRejected uint64
+}
+
+// spoolBatch is where a spooled batch is kept. Each batch is a line of JSON.
+type spoolBatch struct {
+	segment int64
+	offset  int64
+	// size includes the newline
+	size int64
+	// count is the number of measurements in the batch
+	count int
+}
+
+// spoolEntry is the on-disk representation of a single measurement
+type spoolEntry struct {
+	Name        string            `json:"n"`
+	Type        StatType          `json:"y"`
+	Value       interface{}       `json:"v"`
+	Timestamp   int64             `json:"t"`
+	Family      string            `json:"f,omitempty"`
+	Labels      map[string]string `json:"l,omitempty"`
+	Unit        Unit              `json:"u,omitempty"`
+	Description string            `json:"d,omitempty"`
+}
+
+// NewSpoolSink creates a SpoolSink in front of inner. Batches left in the
+// spool by a previous run are replayed on the first Flush.
+func NewSpoolSink(inner Sink, config SpoolConfig) (*SpoolSink, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("spool name must not be empty")
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultSpoolMaxBytes
+	}
+	if config.ReplayLimit <= 0 {
+		config.ReplayLimit = defaultSpoolReplayLimit
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	s := &SpoolSink{
+		config:  config,
+		inner:   inner,
+		pending: make([]Measurement, 0),
+		written: make([]int64, 0),
+		batches: make([]spoolBatch, 0),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write queues the measurements for the next Flush, noting the current time
+// in case they have to be spooled
+func (s *SpoolSink) Write(measurements []Measurement) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := nowFn()
+	for _, m := range measurements {
+		s.pending = append(s.pending, m)
+		s.written = append(s.written, now)
+	}
+	return nil
+}
+
+// Flush replays spooled batches and then delivers the pending batch. If the
+// wrapped sink is still failing the pending batch is added to the spool. Since
+// nothing is lost then, Flush only fails if the spool itself does or if the
+// pending batch was rejected.
+func (s *SpoolSink) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pending, written := s.pending, s.written
+	s.pending = make([]Measurement, 0)
+	s.written = make([]int64, 0)
+
+	backlog, err := s.replay()
+	if err != nil {
+		if spoolErr := s.spool(pending, written); spoolErr != nil {
+			log.Errorf("Failed to spool %v measurements for %v: %v", len(pending), s.config.Name, spoolErr)
+		}
+		return err
+	}
+	if backlog {
+		// New batches queue up behind the spooled ones
+		return s.spool(pending, written)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := s.deliver(pending); err != nil {
+		if IsPermanent(err) {
+			s.rejected += uint64(len(pending))
+			return err
+		}
+		log.Warnf("Spooling %v measurements for %v: %v", len(pending), s.config.Name, err)
+		return s.spool(pending, written)
+	}
+	return nil
+}
+
+// Close flushes and closes the wrapped sink. Undelivered measurements remain
+// in the spool for the next run.
+func (s *SpoolSink) Close() error {
+	err := s.Flush()
+	if closeErr := s.inner.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Name of this stat
+func (s *SpoolSink) Name() string {
+	return fmt.Sprintf("spool-%v", s.config.Name)
+}
+
+// Measure reports the size of the spool and the measurements dropped or
+// rejected since the previous measurement
+func (s *SpoolSink) Measure(channel chan<- Measurement) error {
+	s.mutex.Lock()
+	size := s.size
+	entries := s.entries
+	dropped := s.dropped - s.lastDropped
+	s.lastDropped = s.dropped
+	rejected := s.rejected - s.lastRejected
+	s.lastRejected = s.rejected
+	s.mutex.Unlock()
+
+	now := nowFn()
+	prefix := fmt.Sprintf("machinestatsd.spool.%v", s.config.Name)
+	channel <- &BasicMeasurement{fmt.Sprintf("%v.bytes", prefix), Gauge, size, now, UnitBytes, "Size of the spool"}
+	channel <- &BasicMeasurement{fmt.Sprintf("%v.entries", prefix), Gauge, entries, now, UnitNone, "Measurements waiting in the spool"}
+	channel <- &BasicMeasurement{fmt.Sprintf("%v.dropped", prefix), Counter, dropped, now, UnitNone, "Measurements dropped because the spool was full"}
+	channel <- &BasicMeasurement{fmt.Sprintf("%v.rejected", prefix), Counter, rejected, now, UnitNone, "Measurements dropped because the sink rejected them"}
+	return nil
+}
+
+func (s *SpoolSink) deliver(batch []Measurement) error {
+	if err := s.inner.Write(batch); err != nil {
+		return err
+	}
+	return s.inner.Flush()
+}
+
+// replay delivers spooled batches in order until the spool is empty, the
+// replay limit is reached or delivery fails. Rejected batches are dropped. It
+// reports whether batches are left in the spool and fails only if the spool
+// cannot be read or written.
+func (s *SpoolSink) replay() (bool, error) {
+	if len(s.batches) == 0 {
+		return false, nil
+	}
+	reader := spoolReader{s: s}
+	defer reader.close()
+	replayed := 0
+	var readErr error
+	for replayed < len(s.batches) && replayed < s.config.ReplayLimit {
+		line, err := reader.read(s.batches[replayed])
+		if err != nil {
+			readErr = err
+			break
+		}
+		batch, err := decodeSpoolBatch(line)
+		if err != nil {
+			log.Errorf("Discarding corrupt spool entry: %v", err)
+			replayed++
+			continue
+		}
+		if err := s.deliver(batch); err != nil {
+			if !IsPermanent(err) {
+				log.Warnf("Failed to replay spool for %v: %v", s.config.Name, err)
+				break
+			}
+			log.Errorf("Dropping %v spooled measurements that %v rejected: %v", len(batch), s.config.Name, err)
+			s.rejected += uint64(len(batch))
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		log.Debugf("Replayed %v spooled batches for %v", replayed, s.config.Name)
+		if err := s.advance(replayed); err != nil {
+			return true, err
+		}
+	}
+	if readErr != nil {
+		return true, readErr
+	}
+	return len(s.batches) > 0, nil
+}
+
+// spool appends the batch, which was written at the given times, to the
+// newest segment, dropping the oldest batches if the spool grows too large
+func (s *SpoolSink) spool(batch []Measurement, written []int64) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	entries := make([]spoolEntry, len(batch))
+	for idx, m := range batch {
+		entries[idx] = toSpoolEntry(m, written[idx])
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if s.lastSize > 0 && s.lastSize+int64(len(b)) > s.config.MaxBytes/spoolSegments {
+		s.last++
+		s.lastSize = 0
+	}
+	path := s.segmentPath(s.last)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open spool: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		// Do not leave part of the batch behind
+		os.Truncate(path, s.lastSize)
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.batches = append(s.batches, spoolBatch{s.last, s.lastSize, int64(len(b)), len(batch)})
+	s.lastSize += int64(len(b))
+	s.size += int64(len(b))
+	s.entries += len(batch)
+
+	if s.size > s.config.MaxBytes {
+		return s.trim()
+	}
+	return nil
+}
+
+// trim drops the oldest batches until the spool fits in MaxBytes
+func (s *SpoolSink) trim() error {
+	size := s.size
+	drop := 0
+	for drop < len(s.batches) && size > s.config.MaxBytes {
+		size -= s.batches[drop].size
+		s.dropped += uint64(s.batches[drop].count)
+		drop++
+	}
+	log.Warnf("Spool %v is full, dropped %v batches", s.config.Name, drop)
+	return s.advance(drop)
+}
+
+// advance removes the oldest n batches from the spool, deletes the segments
+// that no longer hold any batches and records where the oldest batch starts
+func (s *SpoolSink) advance(n int) error {
+	for _, b := range s.batches[:n] {
+		s.size -= b.size
+		s.entries -= b.count
+	}
+	s.batches = s.batches[n:]
+	keep := s.last + 1
+	if len(s.batches) > 0 {
+		keep = s.batches[0].segment
+	}
+	for ; s.first < keep; s.first++ {
+		if err := os.Remove(s.segmentPath(s.first)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(s.batches) == 0 {
+		s.last = s.first
+		s.lastSize = 0
+		if err := os.Remove(s.headPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	head := s.batches[0]
+	return writeFileAtomically(s.headPath(), []byte(fmt.Sprintf("%v %v\n", head.segment, head.offset)))
+}
+
+// open indexes the segments that a previous run left behind, starting at the
+// oldest batch that was not replayed yet
+func (s *SpoolSink) open() error {
+	paths, err := filepath.Glob(filepath.Join(s.config.Dir, fmt.Sprintf("%v.*.spool", s.config.Name)))
+	if err != nil {
+		return err
+	}
+	segments := make([]int64, 0, len(paths))
+	for _, path := range paths {
+		seq := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), s.config.Name+"."), ".spool")
+		if segment, err := strconv.ParseInt(seq, 10, 64); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	headSegment, headOffset := int64(0), int64(0)
+	if b, err := ioutil.ReadFile(s.headPath()); err == nil {
+		if _, err := fmt.Sscan(string(b), &headSegment, &headOffset); err != nil {
+			log.Errorf("Ignoring invalid spool head %v: %v", s.headPath(), err)
+			headSegment, headOffset = 0, 0
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read spool head: %w", err)
+	}
+
+	kept := make([]int64, 0, len(segments))
+	for _, segment := range segments {
+		if segment < headSegment {
+			// Replayed before the previous run stopped
+			if err := os.Remove(s.segmentPath(segment)); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, segment)
+		offset := int64(0)
+		if segment == headSegment {
+			offset = headOffset
+		}
+		if err := s.index(segment, offset); err != nil {
+			return err
+		}
+	}
+	if len(kept) > 0 {
+		s.first = kept[0]
+		s.last = kept[len(kept)-1]
+	}
+	return s.advance(0)
+}
+
+// index adds the batches of a segment, starting at offset, to the spool.
+// Whatever follows the last complete batch, which a crash while spooling may
+// have left behind, is cut off.
+func (s *SpoolSink) index(segment int64, offset int64) error {
+	path := s.segmentPath(segment)
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open spool: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read spool: %w", err)
+	}
+	if offset > info.Size() {
+		log.Errorf("Spool head is past the end of %v, skipping it", path)
+		offset = info.Size()
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read spool: %w", err)
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read spool: %w", err)
+		}
+		var entries []spoolEntry
+		// Corrupt batches are kept in the index and discarded when replayed
+		json.Unmarshal(line, &entries)
+		s.batches = append(s.batches, spoolBatch{segment, offset, int64(len(line)), len(entries)})
+		offset += int64(len(line))
+		s.size += int64(len(line))
+		s.entries += len(entries)
+	}
+	s.lastSize = offset
+	return os.Truncate(path, offset)
+}
+
+// segmentPath is the file that holds the given segment
+func (s *SpoolSink) segmentPath(segment int64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%v.%010d.spool", s.config.Name, segment))
+}
+
+// headPath is the file that records where the oldest batch starts
+func (s *SpoolSink) headPath() string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%v.spool.head", s.config.Name))
+}
+
+// spoolReader reads batches from the segments, keeping the segment that it
+// read last open
+type spoolReader struct {
+	s       *SpoolSink
+	file    *os.File
+	segment int64
+}
+
+func (r *spoolReader) read(b spoolBatch) ([]byte, error) {
+	if r.file == nil || r.segment != b.segment {
+		r.close()
+		f, err := os.Open(r.s.segmentPath(b.segment))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spool: %w", err)
+		}
+		r.file, r.segment = f, b.segment
+	}
+	line := make([]byte, b.size)
+	if _, err := r.file.ReadAt(line, b.offset); err != nil {
+		return nil, fmt.Errorf("failed to read spool: %w", err)
+	}
+	return line, nil
+}
+
+func (r *spoolReader) close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// writeFileAtomically replaces the file at path with b
+func writeFileAtomically(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func decodeSpoolBatch(line []byte) ([]Measurement, error) {
+	var entries []spoolEntry
+	if err := json.Unmarshal(line, &entries); err != nil {
+		return nil, err
+	}
+	batch := make([]Measurement, len(entries))
+	for idx, entry := range entries {
+		batch[idx] = newSpooledMeasurement(entry)
+	}
+	return batch, nil
+}
+
+func toSpoolEntry(m Measurement, now int64) spoolEntry {
+	entry := spoolEntry{
+		Name:      m.Name(),
+		Type:      m.Type(),
+		Value:     jsonSafeValue(m.Value()),
+		Timestamp: measurementTime(m, now),
+	}
+	if lm, ok := m.(LabeledMeasurement); ok {
+		entry.Family = lm.Family()
+		entry.Labels = lm.Labels()
+	}
+	entry.Unit, entry.Description = measurementMetadata(m)
+	return entry
+}
+
+type spooledMeasurement struct {
+	entry spoolEntry
+}
+
+type labeledSpooledMeasurement struct {
+	spooledMeasurement
+}
+
+func newSpooledMeasurement(entry spoolEntry) Measurement {
+	m := spooledMeasurement{entry}
+	if entry.Family != "" {
+		return &labeledSpooledMeasurement{m}
+	}
+	return &m
+}
+
+func (s *spooledMeasurement) Name() string {
+	return s.entry.Name
+}
+
+func (s *spooledMeasurement) Type() StatType {
+	return s.entry.Type
+}
+
+func (s *spooledMeasurement) Value() interface{} {
+	return s.entry.Value
+}
+
+func (s *spooledMeasurement) Timestamp() int64 {
+	return s.entry.Timestamp
+}
+
+func (s *spooledMeasurement) Unit() Unit {
+	return s.entry.Unit
+}
+
+func (s *spooledMeasurement) Description() string {
+	return s.entry.Description
+}
+
+func (l *labeledSpooledMeasurement) Family() string {
+	return l.entry.Family
+}
+
+func (l *labeledSpooledMeasurement) Labels() map[string]string {
+	return l.entry.Labels
+}
@@ -0,0 +1,283 @@
+package machinestats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakySink records delivered batches and fails Flush while down is set. It
+// rejects batches that contain the measurement named reject for good.
+type flakySink struct {
+	down      bool
+	reject    string
+	pending   []Measurement
+	delivered []Measurement
+}
+
+func (f *flakySink) Write(measurements []Measurement) error {
+	f.pending = append(f.pending, measurements...)
+	return nil
+}
+
+func (f *flakySink) Flush() error {
+	pending := f.pending
+	f.pending = nil
+	if f.down {
+		return fmt.Errorf("connection refused")
+	}
+	for _, m := range pending {
+		if m.Name() == f.reject {
+			return &PermanentError{fmt.Errorf("bad request")}
+		}
+	}
+	f.delivered = append(f.delivered, pending...)
+	return nil
+}
+
+func (f *flakySink) Close() error {
+	return nil
+}
+
+func collectSpoolStats(t *testing.T, s *SpoolSink) map[string]interface{} {
+	channel := make(chan Measurement, 4)
+	require.Nil(t, s.Measure(channel))
+	close(channel)
+	result := make(map[string]interface{})
+	for m := range channel {
+		result[m.Name()] = m.Value()
+	}
+	return result
+}
+
+func TestSpoolSink(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	now := int64(1000)
+	nowFn = func() int64 { return now }
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	inner := &flakySink{}
+	spool, err := NewSpoolSink(inner, SpoolConfig{Name: "influx", Dir: dir})
+	require.Nil(err)
+
+	var written []Measurement
+	cycle := func(value float64) error {
+		written = []Measurement{
+			&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: value, unit: UnitPercent, description: "Memory used"},
+			&cpuBusyMeasurement{-1, value / 100, 0},
+		}
+		require.Nil(spool.Write(written))
+		err := spool.Flush()
+		now += 1000
+		return err
+	}
+
+	require.Nil(cycle(1))
+	require.Equal(2, len(inner.delivered))
+	// Measurements that are delivered right away are passed on unchanged
+	require.Equal(written, inner.delivered)
+
+	// Outage, during which spooling counts as success
+	inner.down = true
+	require.Nil(cycle(2))
+	require.Nil(cycle(3))
+	stats := collectSpoolStats(t, spool)
+	require.Equal(4, stats["machinestatsd.spool.influx.entries"])
+	require.NotZero(stats["machinestatsd.spool.influx.bytes"])
+
+	// Make sure the spool survives a restart
+	spool, err = NewSpoolSink(inner, SpoolConfig{Name: "influx", Dir: dir})
+	require.Nil(err)
+	require.Equal(4, spool.entries)
+
+	// Recovery replays in order with the original timestamps
+	inner.down = false
+	require.Nil(cycle(4))
+	require.Equal(8, len(inner.delivered))
+	expectedTimes := []int64{2000, 2000, 3000, 3000}
+	for idx, m := range inner.delivered[2:6] {
+		require.Equal(expectedTimes[idx], measurementTime(m, 0), "measurement %v", idx)
+	}
+	require.Equal(written, inner.delivered[6:])
+	require.Equal(3.0, inner.delivered[4].Value())
+	// Units and descriptions survive the spool
+	described, ok := inner.delivered[4].(DescribedMeasurement)
+	require.True(ok)
+	require.Equal(UnitPercent, described.Unit())
+	require.Equal("Memory used", described.Description())
+	labeled, ok := inner.delivered[5].(LabeledMeasurement)
+	require.True(ok)
+	require.Equal(map[string]string{"cpu": "total"}, labeled.Labels())
+
+	require.Equal(0, spool.entries)
+	// Nothing is left on disk once the spool has drained
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(err)
+	require.Empty(files)
+}
+
+func TestSpoolSinkBounded(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	inner := &flakySink{down: true}
+	spool, err := NewSpoolSink(inner, SpoolConfig{Name: "otlp", Dir: dir, MaxBytes: 200})
+	require.Nil(err)
+
+	for idx := 0; idx < 10; idx++ {
+		require.Nil(spool.Write([]Measurement{&BasicMeasurement{name: "connections", measurementType: Gauge, value: idx}}))
+		require.Nil(spool.Flush())
+	}
+	require.True(spool.size <= 200)
+	stats := collectSpoolStats(t, spool)
+	dropped := stats["machinestatsd.spool.otlp.dropped"].(uint64)
+	require.NotZero(dropped)
+	require.Equal(10, int(dropped)+spool.entries)
+	// Dropped is reported as a delta
+	stats = collectSpoolStats(t, spool)
+	require.Equal(uint64(0), stats["machinestatsd.spool.otlp.dropped"])
+
+	// The newest entries are kept
+	inner.down = false
+	require.Nil(spool.Flush())
+	require.Equal(spool.entries, 0)
+	last := inner.delivered[len(inner.delivered)-1]
+	require.Equal(9.0, last.Value())
+}
+
+func TestSpoolSinkKeepsCollectorReady(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	inner := &flakySink{down: true}
+	spool, err := NewSpoolSink(inner, SpoolConfig{Name: "influx", Dir: dir})
+	require.Nil(err)
+	collector := NewCollector(time.Second, spool)
+	collector.Register(&fakeStat{name: "good", values: map[string]interface{}{"good.value": 1}})
+
+	// The outage is covered by the spool, so the daemon stays ready
+	collector.Collect()
+	collector.Collect()
+	health := collector.Health()
+	require.Equal("", health.LastSinkError)
+	require.True(CheckReadiness(health, ReadinessConfig{}, time.Now()).Ready)
+	require.Equal(2, spool.entries)
+}
+
+func TestSpoolSinkRejectedBatches(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	inner := &flakySink{down: true, reject: "bad"}
+	spool, err := NewSpoolSink(inner, SpoolConfig{Name: "otlp", Dir: dir})
+	require.Nil(err)
+	flush := func(name string) error {
+		require.Nil(spool.Write([]Measurement{&BasicMeasurement{name: name, measurementType: Gauge, value: 1}}))
+		return spool.Flush()
+	}
+	for _, name := range []string{"a", "bad", "b"} {
+		require.Nil(flush(name))
+	}
+	require.Equal(3, spool.entries)
+
+	// The rejected batch is dropped instead of holding up the ones behind it
+	inner.down = false
+	require.Nil(spool.Flush())
+	require.Equal(0, spool.entries)
+	require.Len(inner.delivered, 2)
+	require.Equal("a", inner.delivered[0].Name())
+	require.Equal("b", inner.delivered[1].Name())
+
+	// Rejected batches that were not spooled are reported and not spooled
+	err = flush("bad")
+	require.True(IsPermanent(err))
+	require.Equal(0, spool.entries)
+	require.Nil(flush("c"))
+	require.Len(inner.delivered, 3)
+
+	stats := collectSpoolStats(t, spool)
+	require.Equal(uint64(2), stats["machinestatsd.spool.otlp.rejected"])
+	require.Equal(uint64(0), stats["machinestatsd.spool.otlp.dropped"])
+}
+
+func TestSpoolSinkSegments(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	inner := &flakySink{down: true}
+	config := SpoolConfig{Name: "influx", Dir: dir, MaxBytes: 400, ReplayLimit: 3}
+	spool, err := NewSpoolSink(inner, config)
+	require.Nil(err)
+	for idx := 0; idx < 10; idx++ {
+		require.Nil(spool.Write([]Measurement{&BasicMeasurement{name: fmt.Sprintf("m%v", idx), measurementType: Gauge, value: idx, timestamp: 1}}))
+		require.Nil(spool.Flush())
+	}
+	segments := func() []string {
+		paths, err := filepath.Glob(filepath.Join(dir, "influx.*.spool"))
+		require.Nil(err)
+		return paths
+	}
+	before := segments()
+	require.True(len(before) > 2, "expected several segments, got %v", before)
+	last, err := ioutil.ReadFile(before[len(before)-1])
+	require.Nil(err)
+
+	// Replaying deletes the segments that were replayed and leaves the others
+	// alone
+	inner.down = false
+	inner.delivered = nil
+	require.Nil(spool.Flush())
+	require.Len(inner.delivered, 3)
+	after := segments()
+	require.Len(after, len(before)-3)
+	require.Equal(before[len(before)-1], after[len(after)-1])
+	unchanged, err := ioutil.ReadFile(after[len(after)-1])
+	require.Nil(err)
+	require.Equal(last, unchanged)
+
+	// A restart continues with the first batch that was not replayed
+	spool, err = NewSpoolSink(inner, config)
+	require.Nil(err)
+	require.Equal(7, spool.entries)
+	inner.delivered = nil
+	for spool.entries > 0 {
+		require.Nil(spool.Flush())
+	}
+	require.Len(inner.delivered, 7)
+	for idx, m := range inner.delivered {
+		require.Equal(fmt.Sprintf("m%v", idx+3), m.Name())
+	}
+	require.Empty(segments())
+
+	// Batches spooled after the spool drained start a new segment
+	inner.down = true
+	require.Nil(spool.Write([]Measurement{&BasicMeasurement{name: "m10", measurementType: Gauge, value: 10}}))
+	require.Nil(spool.Flush())
+	require.Len(segments(), 1)
+	spool, err = NewSpoolSink(inner, config)
+	require.Nil(err)
+	require.Equal(1, spool.entries)
+}
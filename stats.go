@@ -1,6 +1,12 @@
 package machinestats
 
-import "time"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
 
 var nowFn = func() int64 {
 	return time.Now().UnixNano()
@@ -14,14 +20,122 @@ const (
 	Gauge StatType = iota
 	// Counter for statsd Counter
 	Counter StatType = iota
+	// Timing for statsd Timing. Values are durations in milliseconds.
+	Timing StatType = iota
+	// Histogram for statsd Histogram. Each value is one sample.
+	Histogram StatType = iota
+	// Set for statsd Set. Each value is a member whose unique occurrences are
+	// counted by the backend.
+	Set StatType = iota
+	// Distribution for statsd Distribution. Each value is one sample that is
+	// aggregated globally by the backend.
+	Distribution StatType = iota
 )
 
+// statTypeName is the lowercase name of a StatType
+func statTypeName(statType StatType) string {
+	switch statType {
+	case Counter:
+		return "counter"
+	case Timing:
+		return "timing"
+	case Histogram:
+		return "histogram"
+	case Set:
+		return "set"
+	case Distribution:
+		return "distribution"
+	default:
+		return "gauge"
+	}
+}
+
 // Stat is an abstract interface that is used to get some measurement
 type Stat interface {
 	Name() string
 	Measure(chan<- Measurement) error
 }
 
+// ContextStat is a Stat whose measurement can be cancelled. Collectors call
+// MeasureContext instead of Measure when a stat implements it.
+type ContextStat interface {
+	Stat
+	MeasureContext(ctx context.Context, channel chan<- Measurement) error
+}
+
+// WithContext adapts a Stat to ContextStat. Stats that already implement
+// ContextStat are returned as-is. Others cannot be interrupted, so Measure runs
+// in the background and is abandoned once ctx is done; anything it measures
+// after that is discarded.
+func WithContext(stat Stat) ContextStat {
+	if cs, ok := stat.(ContextStat); ok {
+		return cs
+	}
+	return &contextStatAdapter{Stat: stat}
+}
+
+// abandonedMeasurements counts calls to Measure that were abandoned by
+// WithContext but have not returned yet
+var abandonedMeasurements int64
+
+// errStillMeasuring is returned instead of measuring a stat again while a call
+// to its Measure that was abandoned has not returned yet
+var errStillMeasuring = errors.New("the previous measurement timed out and has not returned yet")
+
+type contextStatAdapter struct {
+	Stat
+	// abandoned is 1 while an abandoned call to Measure is still running
+	abandoned int32
+}
+
+func (a *contextStatAdapter) MeasureContext(ctx context.Context, channel chan<- Measurement) error {
+	// Stats are not safe for concurrent use, and one that hangs would
+	// otherwise leak a goroutine every time it is measured
+	if atomic.LoadInt32(&a.abandoned) == 1 {
+		return errStillMeasuring
+	}
+	inner := make(chan Measurement)
+	result := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("stat '%v' panicked: %v", a.Name(), r)
+			}
+			close(inner)
+			result <- err
+		}()
+		err = a.Measure(inner)
+	}()
+	abandon := func() error {
+		atomic.AddInt64(&abandonedMeasurements, 1)
+		atomic.StoreInt32(&a.abandoned, 1)
+		go func() {
+			defer atomic.AddInt64(&abandonedMeasurements, -1)
+			for range inner {
+			}
+			<-result
+			atomic.StoreInt32(&a.abandoned, 0)
+		}()
+		return ctx.Err()
+	}
+	for {
+		select {
+		case m, ok := <-inner:
+			if !ok {
+				return <-result
+			}
+			select {
+			case channel <- m:
+			case <-ctx.Done():
+				return abandon()
+			}
+		case <-ctx.Done():
+			return abandon()
+		}
+	}
+}
+
 // Measurement represents a measurement
 type Measurement interface {
 	Name() string
@@ -33,6 +147,10 @@ type BasicMeasurement struct {
 	name            string
 	measurementType StatType
 	value           interface{}
+	// timestamp in nanoseconds since the epoch. 0 if unknown
+	timestamp   int64
+	unit        Unit
+	description string
 }
 
 func (bm *BasicMeasurement) Name() string {
@@ -44,3 +162,140 @@ func (bm *BasicMeasurement) Type() StatType {
 func (bm *BasicMeasurement) Value() interface{} {
 	return bm.value
 }
+func (bm *BasicMeasurement) Timestamp() int64 {
+	return bm.timestamp
+}
+func (bm *BasicMeasurement) Unit() Unit {
+	return bm.unit
+}
+func (bm *BasicMeasurement) Description() string {
+	return bm.description
+}
+
+// LabeledMeasurement is implemented by measurements that belong to a family of
+// related metrics which differ only by a set of labels (e.g. per-CPU load).
+// Backends that support labels can use Family and Labels instead of the dotted
+// Name.
+type LabeledMeasurement interface {
+	Measurement
+	Family() string
+	Labels() map[string]string
+}
+
+// toFloat64 converts a measurement value to a float64 when it is numeric
+func toFloat64(input interface{}) (float64, bool) {
+	switch val := input.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case int32:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case uint:
+		return float64(val), true
+	case uint32:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	case bool:
+		if val {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// TimestampedMeasurement is implemented by measurements that know when they
+// were taken. Timestamp returns nanoseconds since the epoch, or 0 if the time
+// is unknown. Collectors stamp measurements with nowFn when they read them.
+type TimestampedMeasurement interface {
+	Measurement
+	Timestamp() int64
+}
+
+// measurementTime returns the timestamp of the measurement, or fallback if it
+// does not carry one
+func measurementTime(m Measurement, fallback int64) int64 {
+	if tm, ok := m.(TimestampedMeasurement); ok && tm.Timestamp() != 0 {
+		return tm.Timestamp()
+	}
+	return fallback
+}
+
+// Unit of a measurement's value
+type Unit string
+
+const (
+	// UnitNone is used for plain counts and values of unknown scale
+	UnitNone Unit = ""
+	// UnitBytes for sizes
+	UnitBytes Unit = "bytes"
+	// UnitSeconds for durations
+	UnitSeconds Unit = "seconds"
+	// UnitMilliseconds for durations, such as those of timings
+	UnitMilliseconds Unit = "milliseconds"
+	// UnitRatio for fractions between 0 and 1
+	UnitRatio Unit = "ratio"
+	// UnitPercent for fractions between 0 and 100
+	UnitPercent Unit = "percent"
+	// UnitBitsPerSecond for data rates
+	UnitBitsPerSecond Unit = "bit/s"
+	// UnitMebibitsPerSecond for data rates in units of 2^20 bits per second
+	UnitMebibitsPerSecond Unit = "Mibit/s"
+)
+
+// prometheusSuffix is the suffix that Prometheus metric names in this unit end
+// with
+func (u Unit) prometheusSuffix() string {
+	switch u {
+	case UnitBitsPerSecond:
+		return "bits_per_second"
+	case UnitMebibitsPerSecond:
+		// Bandwidth has always been exported as mbps
+		return "mbps"
+	}
+	return string(u)
+}
+
+// ucum is the unit's UCUM code, as used by OpenTelemetry
+func (u Unit) ucum() string {
+	switch u {
+	case UnitBytes:
+		return "By"
+	case UnitSeconds:
+		return "s"
+	case UnitMilliseconds:
+		return "ms"
+	case UnitRatio:
+		return "1"
+	case UnitPercent:
+		return "%"
+	case UnitBitsPerSecond:
+		return "bit/s"
+	case UnitMebibitsPerSecond:
+		return "Mibit/s"
+	}
+	return ""
+}
+
+// DescribedMeasurement is implemented by measurements that know the unit of
+// their value and what they measure
+type DescribedMeasurement interface {
+	Measurement
+	Unit() Unit
+	Description() string
+}
+
+// measurementMetadata returns the unit and description of the measurement, if
+// it has any
+func measurementMetadata(m Measurement) (Unit, string) {
+	if dm, ok := m.(DescribedMeasurement); ok {
+		return dm.Unit(), dm.Description()
+	}
+	return UnitNone, ""
+}
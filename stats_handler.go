@@ -0,0 +1,127 @@
+package machinestats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NewStatsHandler returns a handler that serves the collector's latest
+// snapshot as JSON. Values older than two intervals of the stat that produced
+// them are considered stale and omitted.
+//
+// The following query parameters shape the response:
+//
+//   - metric and regex select metrics by glob pattern or regular expression,
+//     see metricFilterFromQuery
+//   - strip_prefix removes a prefix from the names of the metrics that have it
+//   - format=nested expands dotted names into a JSON tree instead of a flat map
+func NewStatsHandler(collector *Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := metricFilterFromQuery(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := query.Get("format")
+		if format != "" && format != "flat" && format != "nested" {
+			http.Error(w, fmt.Sprintf("invalid format %q: expected flat or nested", format), http.StatusBadRequest)
+			return
+		}
+		stripPrefix := query.Get("strip_prefix")
+
+		snapshot := collector.Snapshot()
+		now := time.Now().UnixNano()
+		var measurements map[string]interface{}
+		if fresh := snapshot.Fresh(now); len(fresh) > 0 {
+			// We have recent stats
+			measurements = make(map[string]interface{}, len(fresh))
+			for k, v := range fresh {
+				if !filter.Match(k) {
+					continue
+				}
+				measurements[strings.TrimPrefix(k, stripPrefix)] = jsonSafeValue(v)
+			}
+		}
+		var data interface{} = measurements
+		if len(measurements) == 0 {
+			data = nil
+		} else if format == "nested" {
+			data = unflattenMap(measurements)
+		}
+		m := map[string]interface{}{
+			"timestamp": time.Duration(snapshot.Timestamp).Milliseconds(),
+			"data":      data,
+		}
+		b, _ := json.Marshal(m)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// unflattenMap is the inverse of flattenMap, it expands dotted keys into
+// nested maps. When a key is both a value and the parent of other keys, such
+// as a and a.b, the value is kept under the empty key of the nested map.
+func unflattenMap(data map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	// Sorting makes parents come before their children
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		node := result
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				if value, exists := node[part]; exists {
+					child[""] = value
+				}
+				node[part] = child
+			}
+			node = child
+		}
+		last := parts[len(parts)-1]
+		if child, ok := node[last].(map[string]interface{}); ok {
+			child[""] = data[key]
+			continue
+		}
+		node[last] = data[key]
+	}
+	return result
+}
+
+// metricMetadata is how a measurement is described by NewStatsMetadataHandler
+type metricMetadata struct {
+	Type        string `json:"type"`
+	Unit        Unit   `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// NewStatsMetadataHandler returns a handler that serves the type, unit and
+// description of every measurement in the collector's snapshot as JSON
+func NewStatsMetadataHandler(collector *Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := collector.Snapshot()
+		metadata := make(map[string]metricMetadata, len(snapshot.Entries))
+		for name, entry := range snapshot.Entries {
+			metadata[name] = metricMetadata{
+				Type:        statTypeName(entry.Type),
+				Unit:        entry.Unit,
+				Description: entry.Description,
+			}
+		}
+		b, _ := json.Marshal(map[string]interface{}{
+			"data": metadata,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
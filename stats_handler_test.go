@@ -0,0 +1,124 @@
+package machinestats
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsHandler(t *testing.T) {
+	require := require.New(t)
+
+	collector := NewCollector(time.Second, &syncSink{})
+	collector.Register(&fakeStat{name: "a", values: map[string]interface{}{"a.value": 1.0}})
+	handler := NewStatsHandler(collector)
+
+	get := func() map[string]interface{} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+		var result map[string]interface{}
+		require.Nil(json.Unmarshal(w.Body.Bytes(), &result))
+		return result
+	}
+
+	// Nothing collected yet
+	require.Nil(get()["data"])
+
+	collector.Collect()
+	result := get()
+	require.Equal(map[string]interface{}{"a.value": 1.0}, result["data"])
+	require.Equal(float64(time.Duration(collector.Snapshot().Timestamp).Milliseconds()), result["timestamp"])
+
+	// Stale data is hidden
+	collector.mutex.Lock()
+	entry := collector.snapshot.Entries["a.value"]
+	entry.Timestamp -= int64(3 * time.Second)
+	collector.snapshot.Entries["a.value"] = entry
+	collector.mutex.Unlock()
+	require.Nil(get()["data"])
+}
+
+func TestStatsHandlerQuery(t *testing.T) {
+	require := require.New(t)
+
+	collector := NewCollector(time.Second, &syncSink{})
+	collector.Register(&fakeStat{name: "a", values: map[string]interface{}{
+		"cpu-load.-1":        0.5,
+		"cpu-load.0":         0.25,
+		"coturn.numSessions": 3.0,
+		"memory.used":        10.0,
+	}})
+	collector.Collect()
+	handler := NewStatsHandler(collector)
+
+	get := func(url string) (int, interface{}) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		var result map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result["data"]
+	}
+
+	code, data := get("/stats?metric=cpu-load.-1&metric=coturn.*")
+	require.Equal(200, code)
+	require.Equal(map[string]interface{}{"cpu-load.-1": 0.5, "coturn.numSessions": 3.0}, data)
+
+	_, data = get("/stats?regex=^cpu&strip_prefix=cpu-load.")
+	require.Equal(map[string]interface{}{"-1": 0.5, "0": 0.25}, data)
+
+	_, data = get("/stats?format=nested&regex=cpu|coturn")
+	require.Equal(map[string]interface{}{
+		"cpu-load": map[string]interface{}{"-1": 0.5, "0": 0.25},
+		"coturn":   map[string]interface{}{"numSessions": 3.0},
+	}, data)
+
+	// Nothing matches
+	_, data = get("/stats?metric=missing")
+	require.Nil(data)
+
+	code, _ = get("/stats?format=xml")
+	require.Equal(400, code)
+	code, _ = get("/stats?regex=(")
+	require.Equal(400, code)
+}
+
+func TestUnflattenMap(t *testing.T) {
+	require := require.New(t)
+
+	nested := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": 1,
+			"c": map[string]interface{}{"d": 2},
+		},
+		"e": 3,
+	}
+	require.Equal(nested, unflattenMap(flattenMap(nested, "")))
+
+	// Values that are also parents are kept under the empty key
+	require.Equal(map[string]interface{}{
+		"a": map[string]interface{}{"": 1, "b": 2},
+	}, unflattenMap(map[string]interface{}{"a": 1, "a.b": 2}))
+}
+
+func TestStatsMetadataHandler(t *testing.T) {
+	require := require.New(t)
+
+	collector := NewCollector(time.Second, &syncSink{})
+	collector.Register(&funcStat{"a", func(channel chan<- Measurement) error {
+		channel <- &BasicMeasurement{name: "a.bytes", measurementType: Counter, value: 1, unit: UnitBytes, description: "Bytes"}
+		channel <- &BasicMeasurement{name: "a.plain", measurementType: Gauge, value: 2}
+		return nil
+	}})
+	collector.Collect()
+
+	w := httptest.NewRecorder()
+	NewStatsMetadataHandler(collector).ServeHTTP(w, httptest.NewRequest("GET", "/stats/metadata", nil))
+	require.Equal("application/json", w.Header().Get("Content-Type"))
+	require.JSONEq(`{"data": {
+		"a.bytes": {"type": "counter", "unit": "bytes", "description": "Bytes"},
+		"a.plain": {"type": "gauge"}
+	}}`, w.Body.String())
+}
@@ -0,0 +1,210 @@
+package machinestats
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultStatsdPacketSize keeps datagrams below a typical 1500 byte MTU
+	defaultStatsdPacketSize = 1432
+	defaultStatsdTimeout    = 5 * time.Second
+)
+
+// StatsdConfig configures a StatsdSink
+type StatsdConfig struct {
+	// Address of the statsd server. A udp://, tcp:// or unixgram:// prefix
+	// selects the transport; a bare host:port uses UDP.
+	Address string
+	// Prefix prepended to every metric name
+	Prefix string
+	// MaxPacketSize is the maximum size of a UDP or unix datagram
+	MaxPacketSize int
+	// Timeout for connecting and writing
+	Timeout time.Duration
+}
+
+// StatsdSink sends measurements to a statsd server. Everything written
+// between two calls to Flush is packed into as few datagrams as possible (or
+// streamed in one write over TCP).
+type StatsdSink struct {
+	config  StatsdConfig
+	network string
+	address string
+	conn    net.Conn
+	lines   []string
+}
+
+// NewStatsdSink creates a StatsdSink. The connection is established lazily on
+// the first Flush and re-established after errors.
+func NewStatsdSink(config StatsdConfig) (*StatsdSink, error) {
+	network, address, err := parseStatsdAddress(config.Address)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = defaultStatsdPacketSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultStatsdTimeout
+	}
+	config.Prefix = strings.TrimSuffix(config.Prefix, ".")
+	return &StatsdSink{
+		config:  config,
+		network: network,
+		address: address,
+		lines:   make([]string, 0),
+	}, nil
+}
+
+func parseStatsdAddress(addr string) (string, string, error) {
+	idx := strings.Index(addr, "://")
+	if idx < 0 {
+		return "udp", addr, nil
+	}
+	network := addr[:idx]
+	address := addr[idx+3:]
+	switch network {
+	case "udp", "tcp", "unixgram":
+		return network, address, nil
+	}
+	return "", "", fmt.Errorf("unsupported statsd transport '%v'", network)
+}
+
+// Write formats the measurements and queues them for the next Flush
+func (s *StatsdSink) Write(measurements []Measurement) error {
+	for _, m := range measurements {
+		s.lines = append(s.lines, s.format(m)...)
+		log.Debugf("Logged %v '%v'\n", statTypeName(m.Type()), m.Name())
+	}
+	return nil
+}
+
+// Flush sends all queued metrics. Metrics that could not be sent are dropped
+// and the connection is re-established on the next Flush.
+func (s *StatsdSink) Flush() error {
+	lines := s.lines
+	s.lines = make([]string, 0)
+	if len(lines) == 0 {
+		return nil
+	}
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, s.config.Timeout)
+		if err != nil {
+			return fmt.Errorf("failed to connect to statsd: %w", err)
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+
+	var err error
+	if s.network == "tcp" {
+		_, err = s.conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	} else {
+		err = s.sendPackets(lines)
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("failed to send %v metrics to statsd: %w", len(lines), err)
+	}
+	return nil
+}
+
+// Close flushes queued metrics and closes the connection
+func (s *StatsdSink) Close() error {
+	err := s.Flush()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// sendPackets packs newline separated lines into datagrams no larger than
+// MaxPacketSize. A single line that is larger is sent on its own.
+func (s *StatsdSink) sendPackets(lines []string) error {
+	buf := bytes.Buffer{}
+	send := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > s.config.MaxPacketSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	return send()
+}
+
+// format returns the statsd lines for the measurement
+func (s *StatsdSink) format(m Measurement) []string {
+	name := m.Name()
+	if s.config.Prefix != "" {
+		name = fmt.Sprintf("%v.%v", s.config.Prefix, name)
+	}
+	if m.Type() == Set {
+		member, ok := formatStatsdSetMember(m.Value())
+		if !ok {
+			return nil
+		}
+		return []string{fmt.Sprintf("%v:%v|s", name, member)}
+	}
+	value, ok := toFloat64(m.Value())
+	if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	switch m.Type() {
+	case Counter:
+		return []string{fmt.Sprintf("%v:%v|c", name, formatted)}
+	case Timing:
+		return []string{fmt.Sprintf("%v:%v|ms", name, formatted)}
+	case Histogram:
+		return []string{fmt.Sprintf("%v:%v|h", name, formatted)}
+	case Distribution:
+		return []string{fmt.Sprintf("%v:%v|d", name, formatted)}
+	default:
+		if value < 0 {
+			// A signed gauge is a relative change, so reset it to 0 first
+			return []string{
+				fmt.Sprintf("%v:0|g", name),
+				fmt.Sprintf("%v:%v|g", name, formatted),
+			}
+		}
+		return []string{fmt.Sprintf("%v:%v|g", name, formatted)}
+	}
+}
+
+// formatStatsdSetMember formats a set member. Strings that would break the
+// statsd line format are rejected.
+func formatStatsdSetMember(value interface{}) (string, bool) {
+	if str, ok := value.(string); ok {
+		if str == "" || strings.ContainsAny(str, ":|\n") {
+			return "", false
+		}
+		return str, true
+	}
+	number, ok := toFloat64(value)
+	if !ok || math.IsNaN(number) || math.IsInf(number, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(number, 'f', -1, 64), true
+}
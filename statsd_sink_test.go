@@ -0,0 +1,179 @@
+package machinestats
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readDatagrams(t *testing.T, conn net.PacketConn, count int) []string {
+	packets := make([]string, 0)
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(packets) < count {
+		n, _, err := conn.ReadFrom(buf)
+		require.Nil(t, err)
+		packets = append(packets, string(buf[:n]))
+	}
+	return packets
+}
+
+func TestStatsdSinkUDP(t *testing.T) {
+	require := require.New(t)
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(err)
+	defer listener.Close()
+
+	sink, err := NewStatsdSink(StatsdConfig{
+		Address: listener.LocalAddr().String(),
+		Prefix:  "host.",
+	})
+	require.Nil(err)
+
+	err = sink.Write([]Measurement{
+		&BasicMeasurement{name: "memory-load", measurementType: Gauge, value: 50.5},
+		&BasicMeasurement{name: "requests", measurementType: Counter, value: 3},
+		&BasicMeasurement{name: "temperature", measurementType: Gauge, value: -2},
+		&BasicMeasurement{name: "version", measurementType: Gauge, value: "v1"},
+	})
+	require.Nil(err)
+	require.Nil(sink.Flush())
+
+	packets := readDatagrams(t, listener, 1)
+	require.Equal("host.memory-load:50.5|g\nhost.requests:3|c\nhost.temperature:0|g\nhost.temperature:-2|g", packets[0])
+	require.Nil(sink.Close())
+}
+
+func TestStatsdSinkTypes(t *testing.T) {
+	require := require.New(t)
+
+	sink, err := NewStatsdSink(StatsdConfig{Address: "127.0.0.1:8125"})
+	require.Nil(err)
+
+	tests := []struct {
+		measurement Measurement
+		expected    []string
+	}{
+		{&BasicMeasurement{name: "latency", measurementType: Timing, value: 12.5}, []string{"latency:12.5|ms"}},
+		{&BasicMeasurement{name: "size", measurementType: Histogram, value: 3}, []string{"size:3|h"}},
+		{&BasicMeasurement{name: "users", measurementType: Set, value: "alice"}, []string{"users:alice|s"}},
+		{&BasicMeasurement{name: "users", measurementType: Set, value: 42}, []string{"users:42|s"}},
+		{&BasicMeasurement{name: "users", measurementType: Set, value: "a|b"}, nil},
+		{&BasicMeasurement{name: "payload", measurementType: Distribution, value: -1}, []string{"payload:-1|d"}},
+		{&BasicMeasurement{name: "latency", measurementType: Timing, value: "slow"}, nil},
+	}
+	for _, test := range tests {
+		require.Equal(test.expected, sink.format(test.measurement))
+	}
+}
+
+func TestStatsdSinkPacking(t *testing.T) {
+	require := require.New(t)
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(err)
+	defer listener.Close()
+
+	sink, err := NewStatsdSink(StatsdConfig{
+		Address:       "udp://" + listener.LocalAddr().String(),
+		MaxPacketSize: 100,
+	})
+	require.Nil(err)
+	defer sink.Close()
+
+	batch := make([]Measurement, 0)
+	for idx := 0; idx < 20; idx++ {
+		batch = append(batch, &BasicMeasurement{name: fmt.Sprintf("metric.%02d", idx), measurementType: Gauge, value: idx})
+	}
+	require.Nil(sink.Write(batch))
+	require.Nil(sink.Flush())
+
+	// Lines are 13-14 bytes long, so 6-7 of them fit in each packet
+	packets := readDatagrams(t, listener, 4)
+	lines := make([]string, 0)
+	for _, packet := range packets {
+		require.True(len(packet) <= 100)
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	require.Equal(20, len(lines))
+	require.Equal("metric.00:0|g", lines[0])
+	require.Equal("metric.19:19|g", lines[19])
+}
+
+func TestStatsdSinkTCP(t *testing.T) {
+	require := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	defer listener.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	sink, err := NewStatsdSink(StatsdConfig{Address: "tcp://" + listener.Addr().String()})
+	require.Nil(err)
+
+	require.Nil(sink.Write([]Measurement{
+		&BasicMeasurement{name: "a", measurementType: Gauge, value: 1},
+		&BasicMeasurement{name: "b", measurementType: Gauge, value: 2},
+	}))
+	require.Nil(sink.Flush())
+	require.Equal("a:1|g", <-lines)
+	require.Equal("b:2|g", <-lines)
+
+	// Force a reconnect
+	sink.conn.Close()
+	require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "c", measurementType: Gauge, value: 3}}))
+	require.NotNil(sink.Flush())
+	require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "d", measurementType: Gauge, value: 4}}))
+	require.Nil(sink.Flush())
+	require.Equal("d:4|g", <-lines)
+	require.Nil(sink.Close())
+}
+
+func TestStatsdSinkUnixgram(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-dir")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "statsd.sock")
+
+	listener, err := net.ListenPacket("unixgram", socket)
+	require.Nil(err)
+	defer listener.Close()
+
+	sink, err := NewStatsdSink(StatsdConfig{Address: "unixgram://" + socket})
+	require.Nil(err)
+	defer sink.Close()
+
+	require.Nil(sink.Write([]Measurement{&BasicMeasurement{name: "a", measurementType: Counter, value: 1}}))
+	require.Nil(sink.Flush())
+	require.Equal([]string{"a:1|c"}, readDatagrams(t, listener, 1))
+
+	_, err = NewStatsdSink(StatsdConfig{Address: "http://localhost"})
+	require.NotNil(err)
+}
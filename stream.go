@@ -0,0 +1,203 @@
+package machinestats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// streamBuffer is the number of cycles buffered for each client. Clients that
+// fall further behind miss cycles rather than holding up the collector.
+const streamBuffer = 16
+
+// StreamEvent holds the measurements of a single collection cycle
+type StreamEvent struct {
+	// Timestamp at which the cycle finished, in milliseconds since the epoch
+	Timestamp int64                  `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// StatsStream is a sink that pushes every collection cycle to the clients
+// subscribed to it
+type StatsStream struct {
+	mutex       sync.Mutex
+	pending     map[string]interface{}
+	subscribers map[*streamSubscriber]struct{}
+	closed      bool
+}
+
+type streamSubscriber struct {
+	filter metricFilter
+	events chan StreamEvent
+}
+
+// NewStatsStream creates a StatsStream without any subscribers
+func NewStatsStream() *StatsStream {
+	return &StatsStream{
+		pending:     make(map[string]interface{}),
+		subscribers: make(map[*streamSubscriber]struct{}),
+	}
+}
+
+// Write adds the measurements to the current cycle
+func (s *StatsStream) Write(measurements []Measurement) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, m := range measurements {
+		s.pending[m.Name()] = jsonSafeValue(m.Value())
+	}
+	return nil
+}
+
+// Flush sends the current cycle to every subscriber whose filter matches any
+// of its measurements
+func (s *StatsStream) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	timestamp := time.Duration(nowFn()).Milliseconds()
+	for subscriber := range s.subscribers {
+		data := make(map[string]interface{})
+		for name, value := range s.pending {
+			if subscriber.filter.Match(name) {
+				data[name] = value
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+		select {
+		case subscriber.events <- StreamEvent{timestamp, data}:
+		default:
+			log.Debugf("Stream client is too slow, dropping cycle\n")
+		}
+	}
+	s.pending = make(map[string]interface{})
+	return nil
+}
+
+// Close ends every subscription
+func (s *StatsStream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for subscriber := range s.subscribers {
+		close(subscriber.events)
+		delete(s.subscribers, subscriber)
+	}
+	return nil
+}
+
+// Subscribe returns a channel that receives the cycles matching filter, and a
+// function that ends the subscription. The channel is closed when the stream
+// is closed.
+func (s *StatsStream) Subscribe(filter metricFilter) (<-chan StreamEvent, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subscriber := &streamSubscriber{filter, make(chan StreamEvent, streamBuffer)}
+	if s.closed {
+		close(subscriber.events)
+		return subscriber.events, func() {}
+	}
+	s.subscribers[subscriber] = struct{}{}
+	return subscriber.events, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, ok := s.subscribers[subscriber]; ok {
+			close(subscriber.events)
+			delete(s.subscribers, subscriber)
+		}
+	}
+}
+
+// NewStatsStreamHandler returns a handler that pushes every collection cycle of
+// stream to the client, either as Server-Sent Events or, if the client asks to
+// upgrade, as WebSocket text messages. Each message is a JSON StreamEvent. The
+// metric and regex query parameters limit the stream to the metrics they
+// select, see metricFilterFromQuery.
+func NewStatsStreamHandler(stream *StatsStream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := metricFilterFromQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if isWebSocketUpgrade(r) {
+			serveWebSocketStream(w, r, stream, filter)
+			return
+		}
+		serveEventStream(w, r, stream, filter)
+	})
+}
+
+// serveEventStream streams the cycles as Server-Sent Events
+func serveEventStream(w http.ResponseWriter, r *http.Request, stream *StatsStream, filter metricFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := stream.Subscribe(filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(event)
+			if err != nil {
+				log.Errorf("Failed to encode stream event: %v\n", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// serveWebSocketStream streams the cycles as WebSocket text messages
+func serveWebSocketStream(w http.ResponseWriter, r *http.Request, stream *StatsStream, filter metricFilter) {
+	ws, err := acceptWebSocket(w, r)
+	if err != nil {
+		log.Debugf("Failed to accept WebSocket: %v\n", err)
+		return
+	}
+	defer ws.Close()
+	events, cancel := stream.Subscribe(filter)
+	defer cancel()
+	for {
+		select {
+		case <-ws.Closed():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(event)
+			if err != nil {
+				log.Errorf("Failed to encode stream event: %v\n", err)
+				continue
+			}
+			if err := ws.WriteText(b); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package machinestats
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitForSubscribers waits until the stream has n subscribers
+func waitForSubscribers(t *testing.T, stream *StatsStream, n int) {
+	require.Eventually(t, func() bool {
+		stream.mutex.Lock()
+		defer stream.mutex.Unlock()
+		return len(stream.subscribers) == n
+	}, time.Second, time.Millisecond)
+}
+
+func writeCycle(t *testing.T, stream *StatsStream) {
+	require.Nil(t, stream.Write([]Measurement{
+		&BasicMeasurement{name: "cpu-load.-1", measurementType: Gauge, value: 0.5},
+		&BasicMeasurement{name: "cpu-load.0", measurementType: Gauge, value: 0.25},
+		&BasicMeasurement{name: "memory.used", measurementType: Gauge, value: 10},
+	}))
+	require.Nil(t, stream.Flush())
+}
+
+func TestStatsStream(t *testing.T) {
+	require := require.New(t)
+
+	oldNowFn := nowFn
+	defer func() { nowFn = oldNowFn }()
+	nowFn = func() int64 { return int64(2 * time.Second) }
+
+	stream := NewStatsStream()
+	filter, err := newMetricFilter([]string{"cpu-load.*"}, nil)
+	require.Nil(err)
+	events, cancel := stream.Subscribe(filter)
+	unfiltered, _ := stream.Subscribe(metricFilter{})
+
+	writeCycle(t, stream)
+	require.Equal(StreamEvent{2000, map[string]interface{}{"cpu-load.-1": 0.5, "cpu-load.0": 0.25}}, <-events)
+	require.Len((<-unfiltered).Data, 3)
+
+	// Cycles without matching measurements are not sent
+	require.Nil(stream.Write([]Measurement{&BasicMeasurement{name: "memory.used", measurementType: Gauge, value: 1}}))
+	require.Nil(stream.Flush())
+	require.Len(events, 0)
+	require.Len(unfiltered, 1)
+
+	// Slow clients miss cycles instead of blocking
+	for idx := 0; idx < 2*streamBuffer; idx++ {
+		writeCycle(t, stream)
+	}
+	require.Len(events, streamBuffer)
+
+	cancel()
+	cancel()
+	require.Nil(stream.Close())
+	_, ok := <-unfiltered
+	require.True(ok)
+	for range unfiltered {
+	}
+}
+
+func TestStatsStreamHandlerSSE(t *testing.T) {
+	require := require.New(t)
+
+	stream := NewStatsStream()
+	server := httptest.NewServer(NewStatsStreamHandler(stream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?metric=memory.*")
+	require.Nil(err)
+	defer resp.Body.Close()
+	require.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	waitForSubscribers(t, stream, 1)
+
+	writeCycle(t, stream)
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.Nil(err)
+	require.True(strings.HasPrefix(line, "data: "))
+	var event StreamEvent
+	require.Nil(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+	require.Equal(map[string]interface{}{"memory.used": 10.0}, event.Data)
+
+	// Closing the stream ends the response
+	require.Nil(stream.Close())
+	_, err = io.Copy(ioutil.Discard, reader)
+	require.Nil(err)
+
+	resp, err = http.Get(server.URL + "?metric=[")
+	require.Nil(err)
+	resp.Body.Close()
+	require.Equal(400, resp.StatusCode)
+}
+
+// readServerFrame reads an unmasked frame sent by the server
+func readServerFrame(reader *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(reader, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+func TestStatsStreamHandlerWebSocket(t *testing.T) {
+	require := require.New(t)
+
+	stream := NewStatsStream()
+	server := httptest.NewServer(NewStatsStreamHandler(stream))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.Nil(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /?metric=cpu-load.-1 HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.Nil(err)
+	require.Equal(101, resp.StatusCode)
+	require.Equal("s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	waitForSubscribers(t, stream, 1)
+
+	writeCycle(t, stream)
+	opcode, payload, err := readServerFrame(reader)
+	require.Nil(err)
+	require.Equal(byte(wsText), opcode)
+	var event StreamEvent
+	require.Nil(json.Unmarshal(payload, &event))
+	require.Equal(map[string]interface{}{"cpu-load.-1": 0.5}, event.Data)
+
+	// Pings are answered
+	_, err = conn.Write(maskedFrame(wsPing, []byte("ping")))
+	require.Nil(err)
+	opcode, payload, err = readServerFrame(reader)
+	require.Nil(err)
+	require.Equal(byte(wsPong), opcode)
+	require.Equal("ping", string(payload))
+
+	// Closing the connection ends the subscription
+	_, err = conn.Write(maskedFrame(wsClose, nil))
+	require.Nil(err)
+	opcode, _, err = readServerFrame(reader)
+	require.Nil(err)
+	require.Equal(byte(wsClose), opcode)
+	waitForSubscribers(t, stream, 0)
+
+	// Plain requests without a key are rejected
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	badResp, err := http.DefaultClient.Do(req)
+	require.Nil(err)
+	badResp.Body.Close()
+	require.Equal(400, badResp.StatusCode)
+}
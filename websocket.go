@@ -0,0 +1,230 @@
+package machinestats
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webSocketGUID is appended to the client's key to compute the accept key
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketFrame is the largest frame accepted from a client. Clients are
+// only expected to send control frames.
+const maxWebSocketFrame = 1 << 20
+
+// webSocketWriteTimeout is how long a client may take to accept a frame
+// before it is disconnected
+const webSocketWriteTimeout = 10 * time.Second
+
+// WebSocket opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// webSocketConn is a minimal server side WebSocket (RFC 6455) connection that
+// only sends text messages. Messages from the client are discarded apart from
+// pings, which are answered, and close frames.
+type webSocketConn struct {
+	conn         net.Conn
+	rw           *bufio.ReadWriter
+	writeTimeout time.Duration
+	mutex        sync.Mutex
+	closed       chan struct{}
+	once         sync.Once
+}
+
+// isWebSocketUpgrade returns whether the request asks to upgrade to WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketAcceptKey computes the Sec-WebSocket-Accept header for key
+func webSocketAcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// acceptWebSocket completes the WebSocket handshake and takes over the
+// connection. An error response has already been sent if it fails.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*webSocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "invalid WebSocket handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("invalid WebSocket handshake")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", webSocketAcceptKey(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws := &webSocketConn{
+		conn:         conn,
+		rw:           rw,
+		writeTimeout: webSocketWriteTimeout,
+		closed:       make(chan struct{}),
+	}
+	go ws.readLoop()
+	return ws, nil
+}
+
+// Closed is closed once the connection is closed by either side
+func (ws *webSocketConn) Closed() <-chan struct{} {
+	return ws.closed
+}
+
+// WriteText sends a text message
+func (ws *webSocketConn) WriteText(message []byte) error {
+	return ws.writeFrame(wsText, message)
+}
+
+// Close sends a close frame and closes the connection
+func (ws *webSocketConn) Close() error {
+	ws.writeFrame(wsClose, nil)
+	return ws.close()
+}
+
+func (ws *webSocketConn) close() error {
+	var err error
+	ws.once.Do(func() {
+		close(ws.closed)
+		err = ws.conn.Close()
+	})
+	return err
+}
+
+// writeFrame sends a single frame. A client that does not accept it within
+// the write timeout is disconnected, as is one that the write fails for, since
+// the frame may have been sent partially.
+func (ws *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	if err := ws.sendFrame(opcode, payload); err != nil {
+		ws.close()
+		return err
+	}
+	return nil
+}
+
+func (ws *webSocketConn) sendFrame(opcode byte, payload []byte) error {
+	if err := ws.conn.SetWriteDeadline(time.Now().Add(ws.writeTimeout)); err != nil {
+		return err
+	}
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// readLoop reads frames from the client until the connection is closed
+func (ws *webSocketConn) readLoop() {
+	defer ws.close()
+	for {
+		opcode, payload, err := readWebSocketFrame(ws.rw.Reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsClose:
+			ws.writeFrame(wsClose, nil)
+			return
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+		}
+	}
+}
+
+// readWebSocketFrame reads a single, masked, frame sent by a client
+func readWebSocketFrame(reader io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if !masked {
+		return 0, nil, fmt.Errorf("client frames must be masked")
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(reader, mask); err != nil {
+		return 0, nil, err
+	}
+	if length > maxWebSocketFrame {
+		// Skip over frames that are too large to keep
+		if _, err := io.CopyN(ioutil.Discard, reader, int64(length)); err != nil {
+			return 0, nil, err
+		}
+		return opcode, nil, nil
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for idx := range payload {
+		payload[idx] ^= mask[idx%4]
+	}
+	return opcode, payload, nil
+}
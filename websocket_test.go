@@ -0,0 +1,89 @@
+package machinestats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// maskedFrame encodes a frame the way a client sends it
+func maskedFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	frame = append(frame, mask...)
+	for idx, b := range payload {
+		frame = append(frame, b^mask[idx%4])
+	}
+	return frame
+}
+
+func TestWebSocketAcceptKey(t *testing.T) {
+	// Example from RFC 6455
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", webSocketAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestReadWebSocketFrame(t *testing.T) {
+	require := require.New(t)
+
+	long := bytes.Repeat([]byte("a"), 300)
+	reader := bytes.NewReader(append(maskedFrame(wsPing, []byte("hello")), maskedFrame(wsText, long)...))
+	opcode, payload, err := readWebSocketFrame(reader)
+	require.Nil(err)
+	require.Equal(byte(wsPing), opcode)
+	require.Equal("hello", string(payload))
+
+	opcode, payload, err = readWebSocketFrame(reader)
+	require.Nil(err)
+	require.Equal(byte(wsText), opcode)
+	require.Equal(long, payload)
+
+	// Unmasked frames are rejected
+	_, _, err = readWebSocketFrame(bytes.NewReader([]byte{0x81, 1, 'a'}))
+	require.NotNil(err)
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	require := require.New(t)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	require.False(isWebSocketUpgrade(r))
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "WebSocket")
+	require.True(isWebSocketUpgrade(r))
+}
+
+func TestWebSocketWriteTimeout(t *testing.T) {
+	require := require.New(t)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	ws := &webSocketConn{
+		conn:         server,
+		rw:           bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)),
+		writeTimeout: 50 * time.Millisecond,
+		closed:       make(chan struct{}),
+	}
+
+	// The client never reads, so the write times out and the client is dropped
+	start := time.Now()
+	require.NotNil(ws.WriteText([]byte("hello")))
+	require.True(time.Since(start) < time.Second)
+	select {
+	case <-ws.Closed():
+	default:
+		require.Fail("connection was not closed")
+	}
+	require.NotNil(ws.WriteText([]byte("hello")))
+}